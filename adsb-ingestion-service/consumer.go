@@ -1,137 +1,437 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-schema/broker"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+var (
+	ConsumerClosed  = errors.New("consumer closed")
+	InvalidPrefetch = errors.New("invalid prefetch")
+)
+
+// how many deliveries RabbitMQ sends ahead of their acknowledgement by default
+const DefaultPrefetch = 200
+
+// DefaultRetry waits 1s doubling up to 30s before a delivery that could not be
+// stored is tried again, and dead-letters it after 5 retries.
+var DefaultRetry = broker.Backoff{
+	Initial:    time.Second,
+	Max:        30 * time.Second,
+	MaxRetries: 5,
+}
+
+// Consumer reads the deliveries of the queue. When RabbitMQ drops the channel
+// or the connection, it reconnects with Reconnect, declares the queue again and
+// resumes consuming. Deliveries in flight at that moment cannot be acked
+// anymore, RabbitMQ delivers them again. When RabbitMQ is unavailable at
+// first, StartListening connects the same way.
 type Consumer struct {
-	address         string
-	queue           string
-	connection      *amqp.Connection
-	channel         *amqp.Channel
-	MessagesChannel chan ADSBMessage
+	address      string
+	queue        string
+	mutex        sync.Mutex
+	connection   *amqp.Connection
+	channel      *amqp.Channel
+	channelClose chan *amqp.Error
+	connected    atomic.Bool
+	dial         func() error
+	Topology     broker.Topology
+	Reconnect    broker.Backoff
+	// spaces out and bounds the retries of deliveries the storage was
+	// unavailable for
+	Retry broker.Backoff
+	// how many unacknowledged deliveries RabbitMQ sends at most, 0 is
+	// unlimited
+	Prefetch        int
+	MessagesChannel chan Delivery
 	closeChannel    chan struct{}
 }
 
+// publishChannel is the part of the channel the consumer publishes on, to
+// dead-letter and retry deliveries.
+type publishChannel interface {
+	PublishWithContext(ctx context.Context, exchange string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error
+}
+
 func NewConsumer(address string, queue string) *Consumer {
-	return &Consumer{
+	consumer := &Consumer{
 		address:         address,
 		queue:           queue,
-		MessagesChannel: make(chan ADSBMessage, 50),
-		closeChannel:    make(chan struct{}, 1),
+		Topology:        broker.DefaultTopology,
+		Reconnect:       broker.DefaultBackoff,
+		Retry:           DefaultRetry,
+		Prefetch:        DefaultPrefetch,
+		MessagesChannel: make(chan Delivery, 50),
+		closeChannel:    make(chan struct{}),
 	}
+	consumer.dial = consumer.open
+
+	return consumer
+}
+
+func (p *Consumer) Messages() chan Delivery {
+	return p.MessagesChannel
+}
+
+// Connected tells whether the consumer has a channel to RabbitMQ, false while
+// it reconnects.
+func (p *Consumer) Connected() bool {
+	return p.connected.Load()
 }
 
 func (p *Consumer) Close() error {
+	close(p.closeChannel)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.connected.Store(false)
+	if p.connection == nil {
+		return nil
+	}
+
 	return p.connection.Close()
 }
 
+// Connect opens the channel to RabbitMQ. RabbitMQ being unavailable is not an
+// error, StartListening keeps trying with Reconnect. A queue declared with
+// other settings is, trying again would not change them.
 func (p *Consumer) Connect() error {
+	err := p.dial()
+	if errors.Is(err, ConsumerClosed) || errors.Is(err, broker.TopologyMismatch) {
+		return err
+	}
+	if err != nil {
+		log.Println("RabbitMQ is unavailable, connecting in the background", err)
+		return nil
+	}
+
+	log.Println("Connected to RabbitMQ")
+	return nil
+}
+
+// open dials RabbitMQ, declares the queue and opens the channel consumed.
+func (p *Consumer) open() error {
 	connection, err := amqp.Dial(p.address)
 	if err != nil {
 		return err
 	}
 
-	p.connection = connection
-
-	channel, err := p.connection.Channel()
+	channel, err := connection.Channel()
 	if err != nil {
+		_ = connection.Close()
 		return err
 	}
-	args := make(amqp.Table)
 
-	args["x-message-ttl"] = 5000            // 5 seconds
-	args["x-max-length"] = 500000           // 500k messages
-	args["x-overflow"] = "drop-head"        // drop oldest message
-	args["x-max-length-bytes"] = 2000000000 // 2GB
+	err = p.Topology.Declare(channel, p.queue)
+	if err != nil {
+		_ = connection.Close()
+		return err
+	}
 
-	_, err = channel.QueueDeclare(p.queue, true, false, false, false, args)
+	// without a limit RabbitMQ pushes the whole queue while the processor
+	// stores a few messages at a time
+	err = channel.Qos(p.Prefetch, 0, false)
 	if err != nil {
+		_ = connection.Close()
 		return err
 	}
 
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed() {
+		_ = connection.Close()
+		return ConsumerClosed
+	}
+
+	// the channel is closed with its connection, watching it covers both
+	p.channelClose = channel.NotifyClose(make(chan *amqp.Error, 1))
+	p.connection = connection
 	p.channel = channel
+	p.connected.Store(true)
 
 	return nil
 }
 
+func checkPrefetch(prefetch string) (int, error) {
+	if prefetch == "" {
+		return DefaultPrefetch, nil
+	}
+
+	value, err := strconv.Atoi(prefetch)
+	if err != nil || value < 0 {
+		return 0, InvalidPrefetch
+	}
+
+	return value, nil
+}
+
+func (p *Consumer) closed() bool {
+	select {
+	case <-p.closeChannel:
+		return true
+	default:
+		return false
+	}
+}
+
+// reconnect redials the broker until it answers or the consumer is closed.
+func (p *Consumer) reconnect() bool {
+	p.connected.Store(false)
+
+	p.mutex.Lock()
+	if p.connection != nil {
+		_ = p.connection.Close()
+	}
+	p.mutex.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		delay := p.Reconnect.Delay(attempt)
+		log.Println("Will wait", delay.Round(time.Millisecond), "before reconnecting to RabbitMQ")
+
+		select {
+		case <-p.closeChannel:
+			return false
+		case <-time.After(delay):
+		}
+
+		err := p.dial()
+		if err == nil {
+			log.Println("Reconnected to RabbitMQ")
+			return true
+		}
+		if errors.Is(err, ConsumerClosed) {
+			return false
+		}
+		log.Println("failed to reconnect to RabbitMQ", err)
+	}
+}
+
+// StartListening consumes the queue until the consumer is closed, connecting
+// first when Connect could not, and reconnecting whenever the channel closes.
 func (p *Consumer) StartListening(workers int) error {
 	waitGroup := sync.WaitGroup{}
-	workChannel := make(chan amqp.Delivery, workers)
-	continueScheduling := true
-	failureCount := 0
+	workChannel := make(chan struct{}, workers)
+	defer waitGroup.Wait()
 
-	go func() {
-		<-p.closeChannel
-		continueScheduling = false
-	}()
+	for {
+		if !p.Connected() && !p.reconnect() {
+			return nil
+		}
 
-	delivery, err := p.channel.Consume(p.queue, "adsb-ingestion-service", false, false, false, false, nil)
-	if err != nil {
-		panic(err)
+		p.mutex.Lock()
+		channel := p.channel
+		p.mutex.Unlock()
+
+		delivery, err := channel.Consume(p.queue, "adsb-ingestion-service", false, false, false, false, nil)
+		if err == nil {
+			err = p.consume(channel, delivery, workChannel, &waitGroup)
+		}
+		if errors.Is(err, ConsumerClosed) || p.closed() {
+			return nil
+		}
+
+		log.Println("lost the RabbitMQ channel", err)
+		p.connected.Store(false)
 	}
+}
+
+// consume hands the messages of the deliveries to the processor in the order
+// they come, and settles up to cap(workChannel) deliveries at once, until the
+// delivery channel closes.
+func (p *Consumer) consume(channel publishChannel, delivery <-chan amqp.Delivery, workChannel chan struct{}, waitGroup *sync.WaitGroup) error {
+	for {
+		var d amqp.Delivery
+		var ok bool
 
-	for continueScheduling {
-		d := <-delivery
-		workChannel <- d
+		select {
+		case <-p.closeChannel:
+			return ConsumerClosed
+		case d, ok = <-delivery:
+		}
 
+		if !ok {
+			select {
+			case amqpErr := <-p.channelClose:
+				return fmt.Errorf("%w: %v", amqp.ErrClosed, amqpErr)
+			default:
+				return amqp.ErrClosed
+			}
+		}
+
+		workChannel <- struct{}{}
 		waitGroup.Add(1)
 
+		// concurrent handlers would race to the processor, and the reports
+		// of an aircraft could reach its worker out of order
+		messages, err := schema.Decode(d.ContentType, d.Body)
+		var stored pending
+		if err == nil {
+			stored = dispatch(p.MessagesChannel, messages)
+		}
+
 		go func() {
 			defer waitGroup.Done()
 			defer func() { <-workChannel }()
 
-			var message ADSBMessage
-
-			err := json.Unmarshal(d.Body, &message)
-			if err != nil {
-				if d.Redelivered {
-					err = d.Nack(false, false)
-					if err != nil {
-						failureCount++
-						if failureCount > 10 {
-							panic(err)
-						}
-
-						log.Println("failed to NACK message", err)
-					} else {
-						failureCount = 0
-					}
-				} else {
-					err := d.Nack(false, true)
-					if err != nil {
-						failureCount++
-						if failureCount > 10 {
-							panic(err)
-						}
-
-						log.Println("failed to NACK message", err)
-					} else {
-						failureCount = 0
-					}
-				}
-			}
-
-			p.MessagesChannel <- message
-			err = d.Ack(false)
 			if err != nil {
-				failureCount++
-				if failureCount > 10 {
-					panic(err)
-				}
-
-				log.Println("failed to ACK message", err)
-			} else {
-				failureCount = 0
+				log.Println("failed to decode delivery", err)
+				p.reject(channel, d, err)
+				return
 			}
+			p.settle(channel, d, stored.wait())
 		}()
 	}
+}
 
-	waitGroup.Wait()
+// settle acks a delivery once the processor stored all its messages. It is
+// tried again later when the storage is unavailable, and dead-lettered when
+// its messages cannot be stored or it was retried Retry.MaxRetries times.
+func (p *Consumer) settle(channel publishChannel, d amqp.Delivery, err error) {
+	switch {
+	case err == nil:
+		// fails when the channel was lost meanwhile, the delivery comes again
+		err = d.Ack(false)
+		if err != nil {
+			log.Println("failed to ACK message", err)
+		}
+	case retryable(err):
+		attempt := retries(d) + 1
+		if p.Retry.GivesUp(attempt) {
+			log.Println("failed to store messages, giving up after", attempt-1, "retries", err)
+			p.reject(channel, d, err)
+			return
+		}
 
-	return nil
+		log.Println("failed to store messages, trying them again", err)
+		// waiting in the handler would hold its worker
+		go p.retry(channel, d, attempt)
+	default:
+		log.Println("failed to process messages", err)
+		p.reject(channel, d, err)
+	}
+}
+
+// retries is how many times the delivery was tried again already: put back
+// in the queue by retry, or redelivered by a quorum queue.
+func retries(d amqp.Delivery) int {
+	count := 0
+	for _, header := range []string{broker.HeaderRetries, "x-delivery-count"} {
+		switch value := d.Headers[header].(type) {
+		case int32:
+			count += int(value)
+		case int64:
+			count += int(value)
+		}
+	}
+
+	return count
+}
+
+// retry puts the delivery back in the queue once the Retry delay passed,
+// counting the attempt in its headers. Meanwhile it stays unacknowledged, and
+// RabbitMQ delivers it again when the consumer is closed or the channel lost.
+func (p *Consumer) retry(channel publishChannel, d amqp.Delivery, attempt int) {
+	select {
+	case <-p.closeChannel:
+		return
+	case <-time.After(p.Retry.Delay(attempt)):
+	}
+
+	headers := copyHeaders(d)
+	headers[broker.HeaderRetries] = int32(attempt)
+	headers[broker.HeaderOriginalRoutingKey] = routingKey(d)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the default exchange routes it to the queue alone, not to the others
+	// bound like it
+	err := channel.PublishWithContext(ctx, "", p.queue, false, false, amqp.Publishing{
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		Body:            d.Body,
+		DeliveryMode:    amqp.Persistent,
+		Headers:         headers,
+	})
+	if err != nil {
+		log.Println("failed to put message back in the queue", err)
+		err = d.Nack(false, true)
+	} else {
+		err = d.Ack(false)
+	}
+	if err != nil {
+		log.Println("failed to settle message", err)
+	}
+}
+
+func copyHeaders(d amqp.Delivery) amqp.Table {
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+
+	return headers
+}
+
+// routingKey is the key the delivery was published with, before retry put it
+// back in the queue with the queue's name.
+func routingKey(d amqp.Delivery) string {
+	key, ok := d.Headers[broker.HeaderOriginalRoutingKey].(string)
+	if ok {
+		return key
+	}
+
+	return d.RoutingKey
+}
+
+// reject moves a delivery that will never go through to the dead letters.
+// Without them it is requeued once, and dropped when it comes back.
+func (p *Consumer) reject(channel publishChannel, d amqp.Delivery, reason error) {
+	exchange, key, ok := p.Topology.DeadLetterTarget(broker.DeadLetterDelivery)
+	if !ok {
+		err := d.Nack(false, !d.Redelivered)
+		if err != nil {
+			log.Println("failed to NACK message", err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the original headers and routing key are kept for the replay
+	headers := copyHeaders(d)
+	headers[broker.HeaderFailureReason] = reason.Error()
+	headers[broker.HeaderFailedAt] = time.Now().UTC().Format(time.RFC3339)
+	headers[broker.HeaderOriginalQueue] = p.queue
+	headers[broker.HeaderOriginalRoutingKey] = routingKey(d)
+
+	err := channel.PublishWithContext(ctx, exchange, key, false, false, amqp.Publishing{
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		Body:            d.Body,
+		DeliveryMode:    amqp.Persistent,
+		Headers:         headers,
+	})
+	if err != nil {
+		log.Println("failed to dead-letter message", err)
+		err = d.Nack(false, true)
+	} else {
+		err = d.Ack(false)
+	}
+	if err != nil {
+		log.Println("failed to settle message", err)
+	}
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-schema/broker"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// countingAcknowledger settles deliveries without a broker.
+type countingAcknowledger struct {
+	acked  atomic.Int64
+	nacked atomic.Int64
+}
+
+func (a *countingAcknowledger) Ack(uint64, bool) error {
+	a.acked.Add(1)
+	return nil
+}
+
+func (a *countingAcknowledger) Nack(uint64, bool, bool) error {
+	a.nacked.Add(1)
+	return nil
+}
+
+func (a *countingAcknowledger) Reject(uint64, bool) error {
+	a.nacked.Add(1)
+	return nil
+}
+
+// deliveries are n deliveries of one message each, for aircraft taking turns,
+// with the altitude counting the reports of each aircraft.
+func deliveries(t testing.TB, acknowledger amqp.Acknowledger, n int, aircraft int) chan amqp.Delivery {
+	t.Helper()
+
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	channel := make(chan amqp.Delivery, n)
+	for i := 0; i < n; i++ {
+		message := sbs1Message(schema.TranmissionTypeSurveillanceAltitude, eventTime.Add(time.Duration(i)*time.Millisecond))
+		message.HexIdent = fmt.Sprintf("%06X", 0x400000+i%aircraft)
+		message.Altitude = schema.Some(float64(i / aircraft))
+
+		contentType, body, err := schema.Encode(schema.WireFormatBinary, []schema.ADSBMessage{message})
+		if err != nil {
+			t.Fatal(err)
+		}
+		channel <- amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: uint64(i + 1), ContentType: contentType, Body: body}
+	}
+	close(channel)
+
+	return channel
+}
+
+func TestConsumerKeepsAircraftOrder(t *testing.T) {
+	acknowledger := &countingAcknowledger{}
+	consumer := NewConsumer("", "sbs1")
+
+	// stores take a random time, handlers settling concurrently must not
+	// reorder the reports of an aircraft on their way to the processor
+	received := make(map[string][]float64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for delivery := range consumer.MessagesChannel {
+			received[delivery.Message.HexIdent] = append(received[delivery.Message.HexIdent], delivery.Message.Altitude.Value)
+			go func() {
+				time.Sleep(time.Duration(rand.IntN(100)) * time.Microsecond)
+				delivery.Done(nil)
+			}()
+		}
+	}()
+
+	const n, aircraft = 3000, 7
+	waitGroup := sync.WaitGroup{}
+	_ = consumer.consume(nil, deliveries(t, acknowledger, n, aircraft), make(chan struct{}, 10), &waitGroup)
+	waitGroup.Wait()
+	close(consumer.MessagesChannel)
+	<-done
+
+	if acknowledger.acked.Load() != n {
+		t.Fatalf("acked %d of %d deliveries, nacked %d", acknowledger.acked.Load(), n, acknowledger.nacked.Load())
+	}
+	for hexIdent, altitudes := range received {
+		for i, altitude := range altitudes {
+			if altitude != float64(i) {
+				t.Fatalf("%v: report %v received at %d", hexIdent, altitude, i)
+			}
+		}
+	}
+}
+
+// publication is a message published on a recordingChannel.
+type publication struct {
+	exchange string
+	key      string
+	msg      amqp.Publishing
+}
+
+// recordingChannel keeps what is published on it.
+type recordingChannel struct {
+	mutex     sync.Mutex
+	published []publication
+}
+
+func (c *recordingChannel) PublishWithContext(_ context.Context, exchange string, key string, _ bool, _ bool, msg amqp.Publishing) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.published = append(c.published, publication{exchange: exchange, key: key, msg: msg})
+	return nil
+}
+
+func (c *recordingChannel) publications() []publication {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]publication(nil), c.published...)
+}
+
+// failStoring answers every message of the consumer with err, like a
+// processor which storage is down.
+func failStoring(consumer *Consumer, err error) {
+	go func() {
+		for delivery := range consumer.MessagesChannel {
+			delivery.Done(err)
+		}
+	}()
+}
+
+func TestConsumerRetriesWithoutHoldingWorkers(t *testing.T) {
+	acknowledger := &countingAcknowledger{}
+	consumer := NewConsumer("", "sbs1")
+	consumer.Retry = broker.Backoff{Initial: time.Hour, MaxRetries: 5}
+	failStoring(consumer, FailedToWriteToRedis)
+	channel := &recordingChannel{}
+
+	// a worker waiting for the retry delay would keep the next deliveries
+	// from being settled
+	const n = 20
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		waitGroup := sync.WaitGroup{}
+		_ = consumer.consume(channel, deliveries(t, acknowledger, n, 3), make(chan struct{}, 1), &waitGroup)
+		waitGroup.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers held by the retries")
+	}
+
+	// closing leaves them to RabbitMQ, which delivers them again
+	_ = consumer.Close()
+	time.Sleep(10 * time.Millisecond)
+	if len(channel.publications()) != 0 || acknowledger.acked.Load() != 0 || acknowledger.nacked.Load() != 0 {
+		t.Errorf("published %d, acked %d, nacked %d deliveries waiting for their retry", len(channel.publications()), acknowledger.acked.Load(), acknowledger.nacked.Load())
+	}
+}
+
+func TestConsumerBoundsRetries(t *testing.T) {
+	consumer := NewConsumer("", "sbs1")
+	consumer.Topology.DeadLetterQueue = "sbs1.dead"
+	consumer.Retry = broker.Backoff{Initial: time.Millisecond, MaxRetries: 3}
+	defer consumer.Close()
+	channel := &recordingChannel{}
+
+	for _, test := range []struct {
+		headers amqp.Table
+		key     string
+		retries any
+	}{
+		{headers: nil, key: "sbs1", retries: int32(1)},
+		{headers: amqp.Table{broker.HeaderRetries: int32(2), broker.HeaderReceiver: "feeder-1"}, key: "sbs1", retries: int32(3)},
+		// quorum queues count the redeliveries after a lost channel
+		{headers: amqp.Table{broker.HeaderRetries: int32(1), "x-delivery-count": int64(1)}, key: "sbs1", retries: int32(3)},
+		{headers: amqp.Table{broker.HeaderRetries: int32(3)}, key: "sbs1.dead", retries: int32(3)},
+	} {
+		acknowledger := &countingAcknowledger{}
+		published := len(channel.publications())
+		d := amqp.Delivery{Acknowledger: acknowledger, ContentType: "application/json", Body: []byte("[]"), Headers: test.headers}
+		consumer.settle(channel, d, FailedToWriteToRedis)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for acknowledger.acked.Load() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		publications := channel.publications()
+		if len(publications) != published+1 || acknowledger.acked.Load() != 1 {
+			t.Fatalf("%v: published %d, acked %d", test.headers, len(publications)-published, acknowledger.acked.Load())
+		}
+		publication := publications[published]
+		if publication.exchange != "" || publication.key != test.key {
+			t.Errorf("%v: published to %q %q, want the default exchange and %q", test.headers, publication.exchange, publication.key, test.key)
+		}
+		if retries := publication.msg.Headers[broker.HeaderRetries]; retries != test.retries {
+			t.Errorf("%v: %v retries, want %v", test.headers, retries, test.retries)
+		}
+		if test.headers[broker.HeaderReceiver] != nil && publication.msg.Headers[broker.HeaderReceiver] != test.headers[broker.HeaderReceiver] {
+			t.Errorf("%v: lost the receiver header", test.headers)
+		}
+		if string(publication.msg.Body) != "[]" || publication.msg.ContentType != "application/json" {
+			t.Errorf("%v: published %q %q", test.headers, publication.msg.ContentType, publication.msg.Body)
+		}
+	}
+}
+
+// flakyBroker stands for RabbitMQ, refusing connections while it is down.
+type flakyBroker struct {
+	consumer *Consumer
+	up       atomic.Bool
+	refused  atomic.Int64
+}
+
+func (b *flakyBroker) dial() error {
+	if !b.up.Load() {
+		b.refused.Add(1)
+		return errors.New("connection refused")
+	}
+
+	b.consumer.connected.Store(true)
+	return nil
+}
+
+// waitForHealth polls the health check until it answers status.
+func waitForHealth(t *testing.T, url string, status int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		response, err := http.Get(url + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+		if response.StatusCode == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("health check answered %d, expected %d", response.StatusCode, status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// supervise reconnects the consumer like StartListening does once the channel
+// is lost, while the broker refuses a few connections.
+func supervise(t *testing.T, rabbitMQ *flakyBroker, health string) {
+	t.Helper()
+
+	refused := rabbitMQ.refused.Load()
+	reconnected := make(chan bool)
+	go func() { reconnected <- rabbitMQ.consumer.reconnect() }()
+
+	for rabbitMQ.refused.Load() < refused+3 {
+		time.Sleep(time.Millisecond)
+	}
+	waitForHealth(t, health, http.StatusServiceUnavailable)
+
+	rabbitMQ.up.Store(true)
+	if !<-reconnected {
+		t.Fatal("gave up reconnecting")
+	}
+	waitForHealth(t, health, http.StatusOK)
+}
+
+func TestConsumerHealthFollowsTheConnection(t *testing.T) {
+	consumer := NewConsumer("", "sbs1")
+	consumer.Reconnect = broker.Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond}
+	defer consumer.Close()
+
+	rabbitMQ := &flakyBroker{consumer: consumer}
+	consumer.dial = rabbitMQ.dial
+	health := httptest.NewServer(healthHandler(consumer))
+	defer health.Close()
+
+	// RabbitMQ is down when the service starts, the first connection goes
+	// through the same backoff as the reconnections
+	err := consumer.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(t, health.URL, http.StatusServiceUnavailable)
+	supervise(t, rabbitMQ, health.URL)
+
+	// connected, reconnecting, connected again
+	rabbitMQ.up.Store(false)
+	supervise(t, rabbitMQ, health.URL)
+}
+
+func TestConsumerStopsReconnectingOnceClosed(t *testing.T) {
+	consumer := NewConsumer("", "sbs1")
+	consumer.Reconnect = broker.Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond}
+	consumer.dial = (&flakyBroker{consumer: consumer}).dial
+
+	reconnected := make(chan bool)
+	go func() { reconnected <- consumer.reconnect() }()
+	_ = consumer.Close()
+
+	select {
+	case ok := <-reconnected:
+		if ok {
+			t.Fatal("reconnected a closed consumer")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still reconnecting")
+	}
+}
+
+// BenchmarkConsumerThroughput measures deliveries going through the consumer
+// and the processor workers to the fake RedisJSON and GeoDB. The service needs
+// 120k messages a minute (2000/s), msg/min is what this machine sustains.
+func BenchmarkConsumerThroughput(b *testing.B) {
+	processor, _, _ := testProcessor(b)
+	consumer := NewConsumer("", "sbs1")
+	processor.msgChannel = consumer.MessagesChannel
+	go processor.Start()
+	defer func() {
+		close(processor.closeChannel)
+		<-processor.done
+	}()
+
+	acknowledger := &countingAcknowledger{}
+	delivery := deliveries(b, acknowledger, b.N, 500)
+
+	b.ResetTimer()
+	waitGroup := sync.WaitGroup{}
+	_ = consumer.consume(nil, delivery, make(chan struct{}, 10), &waitGroup)
+	waitGroup.Wait()
+	b.StopTimer()
+
+	if acknowledger.acked.Load() != int64(b.N) {
+		b.Fatalf("acked %d of %d deliveries", acknowledger.acked.Load(), b.N)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Minutes(), "msg/min")
+}
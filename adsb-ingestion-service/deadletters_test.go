@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-schema/broker"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// answer is a confirmation RabbitMQ already sent.
+type answer bool
+
+func (a answer) WaitContext(context.Context) (bool, error) {
+	return bool(a), nil
+}
+
+// fakeDeadLetterQueue is a channel on the dead letter queue. It confirms what
+// is published on it, after returning it when the key is not bound on the
+// exchange.
+type fakeDeadLetterQueue struct {
+	deadLetters []amqp.Delivery
+	bound       map[string]bool
+	confirming  bool
+	returns     chan amqp.Return
+	published   []publication
+}
+
+func (q *fakeDeadLetterQueue) Get(string, bool) (amqp.Delivery, bool, error) {
+	if len(q.deadLetters) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	d := q.deadLetters[0]
+	q.deadLetters = q.deadLetters[1:]
+	return d, true, nil
+}
+
+func (q *fakeDeadLetterQueue) Confirm(bool) error {
+	q.confirming = true
+	return nil
+}
+
+func (q *fakeDeadLetterQueue) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	q.returns = c
+	return c
+}
+
+func (q *fakeDeadLetterQueue) PublishConfirmed(_ context.Context, exchange string, key string, msg amqp.Publishing) (confirmation, error) {
+	if !q.confirming {
+		return nil, errors.New("channel not in confirm mode")
+	}
+
+	q.published = append(q.published, publication{exchange: exchange, key: key, msg: msg})
+	if exchange != "" && !q.bound[key] {
+		q.returns <- amqp.Return{Exchange: exchange, RoutingKey: key}
+	}
+
+	return answer(true), nil
+}
+
+// deadLetter is what Consumer.reject publishes for d, read with the
+// acknowledger of d.
+func deadLetter(t *testing.T, consumer *Consumer, d amqp.Delivery, reason error) amqp.Delivery {
+	t.Helper()
+
+	channel := &recordingChannel{}
+	rejected := d
+	rejected.Acknowledger = &countingAcknowledger{}
+	consumer.reject(channel, rejected, reason)
+	publications := channel.publications()
+	if len(publications) != 1 {
+		t.Fatalf("dead-lettered %d times", len(publications))
+	}
+
+	return amqp.Delivery{
+		Acknowledger: d.Acknowledger,
+		ContentType:  publications[0].msg.ContentType,
+		Body:         publications[0].msg.Body,
+		Headers:      publications[0].msg.Headers,
+		RoutingKey:   publications[0].key,
+	}
+}
+
+// listenerDeadLetter is an SBS1 line the listener could not parse.
+func listenerDeadLetter(acknowledger amqp.Acknowledger) amqp.Delivery {
+	return amqp.Delivery{
+		Acknowledger: acknowledger,
+		ContentType:  "text/plain",
+		Body:         []byte("MSG,3,1"),
+		RoutingKey:   broker.DeadLetterSBS1,
+		Headers: amqp.Table{
+			broker.HeaderFailureReason: "invalid message",
+			broker.HeaderFailedAt:      "2024-03-01T10:00:00Z",
+			broker.HeaderReceiver:      "feeder-1",
+		},
+	}
+}
+
+func testTopology() broker.Topology {
+	topology := broker.DefaultTopology
+	topology.Exchange = "adsb"
+	topology.ExchangeType = broker.ExchangeTopic
+	topology.DeadLetterQueue = "sbs1.dead"
+
+	return topology
+}
+
+func TestListDeadLetters(t *testing.T) {
+	acknowledger := &countingAcknowledger{}
+	consumer := NewConsumer("", "sbs1")
+	consumer.Topology = testTopology()
+	queue := &fakeDeadLetterQueue{deadLetters: []amqp.Delivery{
+		deadLetter(t, consumer, amqp.Delivery{Acknowledger: acknowledger, ContentType: "application/json", Body: []byte("[]")}, FailedToWriteToRedis),
+		listenerDeadLetter(acknowledger),
+	}}
+
+	out := strings.Builder{}
+	err := listDeadLetters(&out, queue, "sbs1.dead", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("listed %q", out.String())
+	}
+	for i, expected := range []string{
+		"\tqueue sbs1\tapplication/json\t2 bytes\t" + FailedToWriteToRedis.Error(),
+		"2\t2024-03-01T10:00:00Z\treceiver feeder-1\ttext/plain\t7 bytes\tinvalid message",
+		"2 dead letters in sbs1.dead",
+	} {
+		if !strings.Contains(lines[i], expected) {
+			t.Errorf("line %d is %q, want %q in it", i+1, lines[i], expected)
+		}
+	}
+
+	// they go back to the queue with the connection
+	if acknowledger.acked.Load() != 0 || acknowledger.nacked.Load() != 0 {
+		t.Errorf("acked %d, nacked %d dead letters", acknowledger.acked.Load(), acknowledger.nacked.Load())
+	}
+}
+
+func TestInspectDeadLetter(t *testing.T) {
+	acknowledger := &countingAcknowledger{}
+	consumer := NewConsumer("", "sbs1")
+	consumer.Topology = testTopology()
+
+	contentType, body, err := schema.Encode(schema.WireFormatBinary, []schema.ADSBMessage{sbs1Message(schema.TranmissionTypeAirbornePosition, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := amqp.Delivery{
+		Acknowledger: acknowledger,
+		ContentType:  contentType,
+		Body:         body,
+		RoutingKey:   "transmission.3",
+		Headers:      amqp.Table{broker.HeaderReceiver: "feeder-1"},
+	}
+	queue := &fakeDeadLetterQueue{deadLetters: []amqp.Delivery{
+		listenerDeadLetter(acknowledger),
+		deadLetter(t, consumer, d, errors.New("cannot store")),
+	}}
+
+	out := strings.Builder{}
+	err = inspectDeadLetter(&out, queue, "sbs1.dead", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"reason:       cannot store\n",
+		"from:         queue sbs1\n",
+		"content type: " + contentType + "\n",
+		"routing key:  transmission.3\n",
+		"x-receiver:   feeder-1\n",
+		// the binary body is dumped
+		"00000000  ",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("%q not in\n%v", expected, out.String())
+		}
+	}
+
+	err = inspectDeadLetter(&strings.Builder{}, &fakeDeadLetterQueue{}, "sbs1.dead", 1)
+	if err == nil {
+		t.Error("inspected a dead letter of an empty queue")
+	}
+	if acknowledger.acked.Load() != 0 || acknowledger.nacked.Load() != 0 {
+		t.Errorf("acked %d, nacked %d dead letters", acknowledger.acked.Load(), acknowledger.nacked.Load())
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	topology := testTopology()
+	consumer := NewConsumer("", "sbs1")
+	consumer.Topology = topology
+	consumer.Retry = broker.Backoff{Initial: time.Millisecond}
+	defer consumer.Close()
+
+	// retried once, then dead-lettered, the delivery must be replayed the
+	// way the listener published it
+	original := amqp.Delivery{
+		Acknowledger: &countingAcknowledger{},
+		ContentType:  "application/json",
+		Body:         []byte("[]"),
+		RoutingKey:   "transmission.3",
+		Headers:      amqp.Table{broker.HeaderReceiver: "feeder-1"},
+	}
+	retried := &recordingChannel{}
+	consumer.retry(retried, original, 1)
+	retry := retried.publications()[0]
+	retriedDelivery := amqp.Delivery{
+		Acknowledger: original.Acknowledger,
+		ContentType:  retry.msg.ContentType,
+		Body:         retry.msg.Body,
+		RoutingKey:   retry.key,
+		Headers:      retry.msg.Headers,
+	}
+
+	acknowledger := &countingAcknowledger{}
+	deadLetters := []amqp.Delivery{
+		deadLetter(t, consumer, retriedDelivery, FailedToWriteToRedis),
+		listenerDeadLetter(acknowledger),
+		// dead-lettered before the routing key was kept
+		{Acknowledger: acknowledger, ContentType: "application/json", Body: []byte("[]"), Headers: amqp.Table{broker.HeaderOriginalQueue: "sbs1"}},
+	}
+	deadLetters[0].Acknowledger = acknowledger
+	queue := &fakeDeadLetterQueue{deadLetters: deadLetters, bound: map[string]bool{"transmission.3": true}}
+
+	out := strings.Builder{}
+	err := replayDeadLetters(&out, queue, topology, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "replayed 2 of 3 dead letters\n" {
+		t.Errorf("printed %q", out.String())
+	}
+	if acknowledger.acked.Load() != 2 {
+		t.Errorf("acked %d dead letters, want the 2 replayed", acknowledger.acked.Load())
+	}
+
+	if len(queue.published) != 2 {
+		t.Fatalf("published %d dead letters", len(queue.published))
+	}
+	replayed := queue.published[0]
+	if replayed.exchange != "adsb" || replayed.key != "transmission.3" {
+		t.Errorf("replayed on %q with %q, want adsb and transmission.3", replayed.exchange, replayed.key)
+	}
+	if replayed.msg.ContentType != "application/json" || string(replayed.msg.Body) != "[]" {
+		t.Errorf("replayed %q %q", replayed.msg.ContentType, replayed.msg.Body)
+	}
+	if len(replayed.msg.Headers) != 1 || replayed.msg.Headers[broker.HeaderReceiver] != "feeder-1" {
+		t.Errorf("replayed with headers %v, want only the original ones", replayed.msg.Headers)
+	}
+	if replayed.msg.Expiration != topology.Expiration() {
+		t.Errorf("replayed expiring in %q, want %q", replayed.msg.Expiration, topology.Expiration())
+	}
+
+	old := queue.published[1]
+	if old.exchange != "" || old.key != "sbs1" {
+		t.Errorf("old dead letter replayed on %q with %q, want its queue", old.exchange, old.key)
+	}
+}
+
+func TestReplayStopsAtUnroutableDeadLetters(t *testing.T) {
+	acknowledger := &countingAcknowledger{}
+	consumer := NewConsumer("", "sbs1")
+	consumer.Topology = testTopology()
+	d := amqp.Delivery{Acknowledger: acknowledger, ContentType: "application/json", Body: []byte("[]"), RoutingKey: "transmission.3"}
+	queue := &fakeDeadLetterQueue{deadLetters: []amqp.Delivery{
+		deadLetter(t, consumer, d, FailedToWriteToRedis),
+		deadLetter(t, consumer, d, FailedToWriteToRedis),
+	}}
+
+	err := replayDeadLetters(&strings.Builder{}, queue, consumer.Topology, 10)
+	if !errors.Is(err, UnroutableDeadLetter) {
+		t.Fatalf("got %v, want UnroutableDeadLetter", err)
+	}
+	if len(queue.published) != 1 || acknowledger.acked.Load() != 0 {
+		t.Errorf("published %d, acked %d dead letters", len(queue.published), acknowledger.acked.Load())
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// serveHealth answers /healthz with 200 while the source is connected and 503
+// while it is not, for liveness and readiness probes.
+func serveHealth(address string, source Source) {
+	log.Println("Serving health checks on", address)
+	err := http.ListenAndServe(address, healthHandler(source))
+	if err != nil {
+		log.Println("failed to serve health checks", err)
+	}
+}
+
+func healthHandler(source Source) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if !source.Connected() {
+			http.Error(w, "disconnected from "+sourceName, http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	return mux
+}
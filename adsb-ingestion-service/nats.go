@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-schema/broker"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSConsumer reads the messages of the listener's JetStream stream through
+// a durable consumer, so a restart resumes where the service stopped. It
+// works like the RabbitMQ Consumer: messages are delivered to MessagesChannel
+// and acknowledged once stored. JetStream has no dead letter queue, messages
+// that will never go through are terminated.
+//
+// The client connects and reconnects in the background. When the server is
+// unavailable at first, StartListening declares the stream and the consumer
+// once it answers, trying again with Reconnect.
+type NATSConsumer struct {
+	url        string
+	stream     string
+	subject    string
+	connection *nats.Conn
+	consumer   jetstream.Consumer
+	Reconnect  broker.Backoff
+	// spaces out and bounds the redeliveries of messages the storage was
+	// unavailable for
+	Retry broker.Backoff
+	// how many messages are pulled ahead of the workers
+	Prefetch        int
+	MessagesChannel chan Delivery
+	closeChannel    chan struct{}
+}
+
+func NewNATSConsumer(url string, stream string, subject string) *NATSConsumer {
+	return &NATSConsumer{
+		url:             url,
+		stream:          stream,
+		subject:         subject,
+		Reconnect:       broker.DefaultBackoff,
+		Retry:           DefaultRetry,
+		Prefetch:        DefaultPrefetch,
+		MessagesChannel: make(chan Delivery, 50),
+		closeChannel:    make(chan struct{}),
+	}
+}
+
+func (c *NATSConsumer) Messages() chan Delivery {
+	return c.MessagesChannel
+}
+
+func (c *NATSConsumer) Connected() bool {
+	return c.connection != nil && c.connection.IsConnected()
+}
+
+func (c *NATSConsumer) Close() error {
+	close(c.closeChannel)
+
+	if c.connection == nil {
+		return nil
+	}
+
+	return c.connection.Drain()
+}
+
+func (c *NATSConsumer) Connect() error {
+	connection, err := nats.Connect(c.url,
+		nats.Name("adsb-ingestion-service"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			// err is nil when the connection is closed on purpose
+			if err != nil {
+				log.Println("lost connection to NATS", err)
+			}
+		}),
+		nats.ConnectHandler(func(_ *nats.Conn) {
+			log.Println("Connected to NATS")
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			log.Println("Reconnected to NATS")
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	c.connection = connection
+
+	if !connection.IsConnected() {
+		log.Println("NATS is unavailable, connecting in the background")
+		return nil
+	}
+
+	return c.declare()
+}
+
+// declare creates the stream, when the listener has not yet, and the durable
+// consumer.
+func (c *NATSConsumer) declare() error {
+	jetStream, err := jetstream.New(c.connection)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = jetStream.CreateOrUpdateStream(ctx, broker.NATSStreamConfig(c.stream, c.subject))
+	if err != nil {
+		return err
+	}
+
+	c.consumer, err = jetStream.CreateOrUpdateConsumer(ctx, c.stream, jetstream.ConsumerConfig{
+		Durable:       "adsb-ingestion-service",
+		FilterSubject: c.subject + ".>",
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       30 * time.Second,
+	})
+
+	return err
+}
+
+// waitForConsumer declares the consumer until the server answers or the
+// consumer is closed.
+func (c *NATSConsumer) waitForConsumer() bool {
+	for attempt := 1; c.consumer == nil; attempt++ {
+		delay := c.Reconnect.Delay(attempt)
+		log.Println("Will wait", delay.Round(time.Millisecond), "before declaring the NATS consumer")
+
+		select {
+		case <-c.closeChannel:
+			return false
+		case <-time.After(delay):
+		}
+
+		err := c.declare()
+		if err != nil {
+			log.Println("failed to declare the NATS consumer", err)
+		}
+	}
+
+	return true
+}
+
+func (c *NATSConsumer) StartListening(workers int) error {
+	if !c.waitForConsumer() {
+		return nil
+	}
+
+	waitGroup := sync.WaitGroup{}
+	workChannel := make(chan struct{}, workers)
+
+	// messages come one at a time and are handed to the processor in that
+	// order, up to workers of them are settled at once like the RabbitMQ
+	// deliveries
+	consumeContext, err := c.consumer.Consume(func(msg jetstream.Msg) {
+		workChannel <- struct{}{}
+		waitGroup.Add(1)
+
+		messages, err := schema.Decode(msg.Headers().Get(broker.NATSContentTypeHeader), msg.Data())
+		var stored pending
+		if err == nil {
+			stored = dispatch(c.MessagesChannel, messages)
+		}
+
+		go func() {
+			defer waitGroup.Done()
+			defer func() { <-workChannel }()
+
+			if err == nil {
+				err = stored.wait()
+			}
+			c.settle(msg, err)
+		}()
+	}, jetstream.PullMaxMessages(max(c.Prefetch, workers)), jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		log.Println("failed to consume from NATS", err)
+	}))
+	if err != nil {
+		return err
+	}
+
+	<-c.closeChannel
+	consumeContext.Stop()
+	waitGroup.Wait()
+
+	return nil
+}
+
+// settle acks a message once the processor stored it, like Consumer.settle.
+func (c *NATSConsumer) settle(msg jetstream.Msg, err error) {
+	switch {
+	case err == nil:
+		err = msg.Ack()
+	case retryable(err):
+		attempt := 1
+		metadata, metadataErr := msg.Metadata()
+		if metadataErr == nil {
+			attempt = int(metadata.NumDelivered)
+		}
+		if c.Retry.GivesUp(attempt) {
+			log.Println("failed to store messages, terminating them after", attempt-1, "redeliveries", err)
+			err = msg.Term()
+			break
+		}
+
+		log.Println("failed to store messages, redelivering them", err)
+		err = msg.NakWithDelay(c.Retry.Delay(attempt))
+	default:
+		log.Println("failed to process message, terminating it", err)
+		err = msg.Term()
+	}
+	if err != nil {
+		log.Println("failed to settle message", err)
+	}
+}
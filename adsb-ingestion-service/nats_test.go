@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-schema/broker"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// freePort is a port nothing listens on, for a server started later.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// runNATSServer starts an in-process NATS server with JetStream.
+func runNATSServer(t *testing.T, port int) *server.Server {
+	t.Helper()
+
+	natsServer, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(natsServer.Shutdown)
+
+	return natsServer
+}
+
+// publishNATS publishes the messages the way the listener does.
+func publishNATS(t *testing.T, url string, messages ...schema.ADSBMessage) {
+	t.Helper()
+
+	connection, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	jetStream, err := jetstream.New(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, message := range messages {
+		contentType, body, err := schema.Encode(schema.WireFormatJSON, []schema.ADSBMessage{message})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := nats.NewMsg("adsb." + message.HexIdent)
+		msg.Header.Set(broker.NATSContentTypeHeader, contentType)
+		msg.Data = body
+		_, err = jetStream.PublishMsg(ctx, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitForStream waits for the consumer to declare the stream.
+func waitForStream(t *testing.T, url string) {
+	t.Helper()
+
+	connection, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	jetStream, err := jetstream.New(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = jetStream.Stream(context.Background(), "ADSB")
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream never declared", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func nextDelivery(t *testing.T, consumer *NATSConsumer) Delivery {
+	t.Helper()
+
+	select {
+	case delivery := <-consumer.MessagesChannel:
+		return delivery
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+		return Delivery{}
+	}
+}
+
+// ackPending is how many messages the consumer was sent and has not acked.
+func ackPending(t *testing.T, consumer *NATSConsumer) int {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	info, err := consumer.consumer.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info.NumAckPending
+}
+
+func waitForAckPending(t *testing.T, consumer *NATSConsumer, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ackPending(t, consumer) != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := ackPending(t, consumer); got != want {
+		t.Fatalf("%d messages waiting for their ack, want %d", got, want)
+	}
+}
+
+func TestNATSConsumerAcksOnceStored(t *testing.T) {
+	natsServer := runNATSServer(t, -1)
+
+	consumer := NewNATSConsumer(natsServer.ClientURL(), "ADSB", "adsb")
+	err := consumer.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go consumer.StartListening(2)
+	defer consumer.Close()
+
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	publishNATS(t, natsServer.ClientURL(), sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime))
+
+	// held until the processor is done with it
+	delivery := nextDelivery(t, consumer)
+	time.Sleep(50 * time.Millisecond)
+	waitForAckPending(t, consumer, 1)
+
+	delivery.Done(nil)
+	waitForAckPending(t, consumer, 0)
+	select {
+	case <-consumer.MessagesChannel:
+		t.Fatal("acked message delivered again")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNATSConsumerRedeliversWhenStorageFails(t *testing.T) {
+	natsServer := runNATSServer(t, -1)
+
+	consumer := NewNATSConsumer(natsServer.ClientURL(), "ADSB", "adsb")
+	err := consumer.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go consumer.StartListening(2)
+	defer consumer.Close()
+
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	publishNATS(t, natsServer.ClientURL(), sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime))
+
+	nextDelivery(t, consumer).Done(FailedToWriteToRedis)
+	// it comes back after the delay
+	redelivery := nextDelivery(t, consumer)
+	if redelivery.Message.HexIdent != "4CA2D6" {
+		t.Fatalf("got %+v", redelivery.Message)
+	}
+	redelivery.Done(nil)
+	waitForAckPending(t, consumer, 0)
+
+	// a message that will never be stored is not redelivered
+	publishNATS(t, natsServer.ClientURL(), sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime))
+	nextDelivery(t, consumer).Done(errors.New("not JSON"))
+	waitForAckPending(t, consumer, 0)
+}
+
+func TestNATSConsumerWaitsForTheServer(t *testing.T) {
+	port := freePort(t)
+
+	consumer := NewNATSConsumer("nats://127.0.0.1:"+strconv.Itoa(port), "ADSB", "adsb")
+	consumer.Reconnect = broker.Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	err := consumer.Connect()
+	if err != nil {
+		t.Fatalf("failed while the server is down: %v", err)
+	}
+	if consumer.Connected() {
+		t.Fatal("connected without a server")
+	}
+	go consumer.StartListening(2)
+	defer consumer.Close()
+
+	natsServer := runNATSServer(t, port)
+	waitForStream(t, natsServer.ClientURL())
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	publishNATS(t, natsServer.ClientURL(), sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime))
+
+	nextDelivery(t, consumer).Done(nil)
+	if !consumer.Connected() {
+		t.Error("not connected once the server is up")
+	}
+}
@@ -1,43 +1,83 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	schema "github.com/fabricekabongo/adsb-schema"
 	"github.com/redis/go-redis/v9"
+	"hash/fnv"
+	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	FailedToWriteToGeoDB       = errors.New("failed to write to GeoDB")
 	FailedToWriteToRedis       = errors.New("failed to write to Redis")
+	FailedToReadFromRedis      = errors.New("failed to read from Redis")
 	InvalidLocationCoordinates = errors.New("invalid location coordinates")
+	InvalidWorkers             = errors.New("invalid number of workers")
 )
 
+// how many messages are stored at once by default
+const DefaultWorkers = 8
+
+// SBS1Processor stores the messages in Redis and GeoDB with Workers workers.
+// The messages of an aircraft always go to the same worker, so they are stored
+// in the order they come.
 type SBS1Processor struct {
 	geoDB        net.Conn
+	geoDBMutex   sync.Mutex
 	geoDBUrl     string
 	redis        redis.Client
 	redisUrl     string
-	msgChannel   chan ADSBMessage
+	msgChannel   chan Delivery
 	ctx          context.Context
-	processing   bool
+	Workers      int
 	closeChannel chan struct{}
+	done         chan struct{}
+	// timezone of the SBS1 timestamps of messages sent without an event time
+	timezone *time.Location
 }
 
-func NewSBS1Processor(geoDBUrl string, redisUrl string, msgChannel chan ADSBMessage) *SBS1Processor {
+func NewSBS1Processor(geoDBUrl string, redisUrl string, msgChannel chan Delivery) *SBS1Processor {
 	var ctx = context.Background()
 
 	return &SBS1Processor{
-		geoDBUrl:   geoDBUrl,
-		redisUrl:   redisUrl,
-		msgChannel: msgChannel,
-		ctx:        ctx,
-		processing: false,
+		geoDBUrl:     geoDBUrl,
+		redisUrl:     redisUrl,
+		msgChannel:   msgChannel,
+		ctx:          ctx,
+		Workers:      DefaultWorkers,
+		closeChannel: make(chan struct{}),
+		done:         make(chan struct{}),
+		timezone:     time.UTC,
+	}
+}
+
+func checkWorkers(workers string) (int, error) {
+	if workers == "" {
+		return DefaultWorkers, nil
+	}
+
+	value, err := strconv.Atoi(workers)
+	if err != nil || value < 1 {
+		return 0, InvalidWorkers
 	}
+
+	return value, nil
+}
+
+// SetReceiverTimezone sets the timezone the SBS1 timestamps are read in, for
+// listeners that do not send the event time yet.
+func (p *SBS1Processor) SetReceiverTimezone(timezone *time.Location) {
+	p.timezone = timezone
 }
 
 func (p *SBS1Processor) Connect() error {
@@ -79,9 +119,14 @@ func (p *SBS1Processor) connectToRedis() error {
 	return nil
 }
 
+// Close lets the workers finish the messages they hold, for a few seconds.
 func (p *SBS1Processor) Close() error {
-	p.closeChannel <- struct{}{}
-	time.Sleep(3 * time.Second)
+	close(p.closeChannel)
+	select {
+	case <-p.done:
+	case <-time.After(3 * time.Second):
+	}
+
 	err := p.geoDB.Close()
 	if err != nil {
 		log.Println("failed to close connection to TCP server", err)
@@ -94,104 +139,417 @@ func (p *SBS1Processor) Close() error {
 	return err
 }
 
+// Start hands the messages to the workers until the processor is closed.
 func (p *SBS1Processor) Start() {
-	p.processing = true
+	defer close(p.done)
+
+	waitGroup := sync.WaitGroup{}
+	shards := make([]chan Delivery, max(p.Workers, 1))
+	for i := range shards {
+		shards[i] = make(chan Delivery, 100)
+		waitGroup.Add(1)
+
+		go func(shard chan Delivery) {
+			defer waitGroup.Done()
+
+			for delivery := range shard {
+				delivery.Done(p.process(delivery.Message))
+			}
+		}(shards[i])
+	}
+
+	defer waitGroup.Wait()
+	for _, shard := range shards {
+		defer close(shard)
+	}
+
+	for {
+		select {
+		case <-p.closeChannel:
+			return
+		case delivery := <-p.msgChannel:
+			shards[shardOf(delivery.Message.HexIdent, len(shards))] <- delivery
+		}
+	}
+}
+
+// shardOf is the worker storing the messages of an aircraft.
+func shardOf(hexIdent string, shards int) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(hexIdent))
+
+	return int(hash.Sum32() % uint32(shards))
+}
+
+// process stores the message. It fails with FailedToReadFromRedis,
+// FailedToWriteToRedis or FailedToWriteToGeoDB when the storage is
+// unavailable.
+func (p *SBS1Processor) process(message schema.ADSBMessage) error {
+	// clicks carry nothing about an aircraft
+	if message.MessageType == schema.MessageTypeClick {
+		return nil
+	}
+
+	p.setEventTime(&message)
+
+	storedMessage, err := p.redis.JSONGet(p.ctx, message.HexIdent, "$").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("%w: %w", FailedToReadFromRedis, err)
+	}
+	stored := storedMessage != ""
+	times := parseEventTimes(storedMessage)
+
+	// reports arrive out of order across receivers and redeliveries, an
+	// older one must not overwrite what a newer one set. Each group of
+	// fields is compared on its own, a late position still moves the
+	// aircraft when a newer altitude came first.
+	group := fieldGroup(message)
+	if group != "" && message.EventTime.Before(times.of(group)) {
+		return nil
+	}
+	newest := !message.EventTime.Before(times.EventTime)
+
+	if message.MessageType == schema.MessageTypeStatusChange {
+		return p.handleStatusMessage(message, stored, newest)
+	}
+	if group == "" && !newest {
+		return nil
+	}
 
-	go func() {
-		<-p.closeChannel
-		p.processing = false
-	}()
+	// the first message of an aircraft stores it whole, its position still
+	// goes to GeoDB below. Its event time is already in, a redelivery is not
+	// stale as it is not older.
+	if !stored {
+		err = p.set(message.HexIdent, "$", message)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.handleLocationMessage(message)
+	if err != nil {
+		log.Println("Failed to handle location message", err)
+		if errors.Is(err, FailedToWriteToGeoDB) {
+			p.reconnectToGeoDB()
+		}
+		return err
+	}
 
-	for p.processing {
-		message := <-p.msgChannel
-		storedMessage, err := p.redis.JSONGet(p.ctx, message.HexIdent, "$").Result()
+	err = errors.Join(
+		p.handleIdentityMessage(message),
+		p.handleVelocityMessage(message),
+		p.handleAltitudeMessage(message),
+	)
+	if err != nil {
+		return err
+	}
+
+	return p.setEventTimes(message, group, stored && newest)
+}
+
+// setEventTimes records the message as the newest of its group and, when it
+// is, of the aircraft. It comes after every other write so a message that
+// failed halfway is not taken as stale when it is delivered again.
+func (p *SBS1Processor) setEventTimes(message schema.ADSBMessage, group string, newest bool) error {
+	if group != "" {
+		err := p.set(message.HexIdent, "."+group+"_event_time", message.EventTime)
 		if err != nil {
-			continue
+			return err
 		}
+	}
+
+	if !newest {
+		return nil
+	}
+
+	err := errors.Join(
+		p.set(message.HexIdent, ".generatedDate", message.DateMessageGenerated),
+		p.set(message.HexIdent, ".generatedTime", message.TimeMessageGenerated),
+	)
+	if err != nil {
+		return err
+	}
+
+	return p.set(message.HexIdent, ".event_time", message.EventTime)
+}
+
+// set writes a value of the aircraft in Redis. The value is always encoded
+// here: go-redis sends strings as they are, as if they were JSON already.
+func (p *SBS1Processor) set(hexIdent string, path string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	err = p.redis.JSONSet(p.ctx, hexIdent, path, encoded).Err()
+	if err != nil {
+		return fmt.Errorf("%w: %w", FailedToWriteToRedis, err)
+	}
+
+	return nil
+}
+
+// reconnectToGeoDB gives GeoDB a moment and reconnects. The message that
+// failed is tried again, as long as it takes GeoDB to come back.
+func (p *SBS1Processor) reconnectToGeoDB() {
+	p.geoDBMutex.Lock()
+	failed := p.geoDB
+	p.geoDBMutex.Unlock()
+
+	time.Sleep(10 * time.Second)
+
+	p.geoDBMutex.Lock()
+	defer p.geoDBMutex.Unlock()
 
-		if storedMessage == "" {
-			p.redis.JSONSet(p.ctx, message.HexIdent, "$", message)
-			continue
-		} else {
-			log.Println("Message found in Redis. Updating:")
-			p.redis.JSONSet(p.ctx, message.HexIdent, ".generatedDate", message.DateMessageGenerated)
-			p.redis.JSONSet(p.ctx, message.HexIdent, ".generatedTime", message.TimeMessageGenerated)
-
-			err = p.handleLocationMessage(message)
-			if err != nil {
-				log.Println("Failed to handle location message", err)
-				if errors.Is(err, FailedToWriteToGeoDB) {
-					time.Sleep(10 * time.Second)
-					err := p.connectToGeoDB()
-					if err != nil {
-						log.Fatalln("Failed to reconnect to GeoDB", err)
-					}
-				}
+	// another worker reconnected meanwhile
+	if p.geoDB != failed {
+		return
+	}
+
+	_ = failed.Close()
+	err := p.connectToGeoDB()
+	if err != nil {
+		log.Println("Failed to reconnect to GeoDB", err)
+	}
+}
+
+// writeGeoDB sends a command to GeoDB. The workers share the connection, a
+// command is written at once so they do not interleave.
+func (p *SBS1Processor) writeGeoDB(command string) error {
+	p.geoDBMutex.Lock()
+	defer p.geoDBMutex.Unlock()
+
+	_, err := io.WriteString(p.geoDB, command)
+
+	return err
+}
+
+// replies of a Redis loading its data, failing over or resharding, which
+// answers the same command once it is done
+var unavailableReplies = []string{"LOADING", "READONLY", "MASTERDOWN", "TRYAGAIN", "CLUSTERDOWN"}
+
+// retryable tells whether a failure comes from the storage being unavailable,
+// the message is then worth trying again later. Other failures, Redis refusing
+// the command included, are the message's own.
+func retryable(err error) bool {
+	if errors.Is(err, FailedToWriteToGeoDB) {
+		return true
+	}
+
+	var reply redis.Error
+	if errors.As(err, &reply) {
+		for _, unavailable := range unavailableReplies {
+			if strings.HasPrefix(reply.Error(), unavailable+" ") || reply.Error() == unavailable {
+				return true
 			}
-			_ = p.handleIdentityMessage(message)
-			_ = p.handleVelocityMessage(message)
-			_ = p.handleAltitudeMessage(message)
 		}
+		return false
+	}
+
+	return errors.Is(err, FailedToReadFromRedis) || errors.Is(err, FailedToWriteToRedis)
+}
+
+// setEventTime fills the times of messages from listeners that only send the
+// SBS1 date and time fields.
+func (p *SBS1Processor) setEventTime(message *schema.ADSBMessage) {
+	if message.IngestTime.IsZero() {
+		message.IngestTime = time.Now().UTC()
+	}
+
+	if !message.EventTime.IsZero() {
+		return
+	}
+
+	eventTime, err := schema.ParseSBS1Time(message.DateMessageGenerated, message.TimeMessageGenerated, p.timezone)
+	if err != nil {
+		eventTime = message.IngestTime
+	}
+	message.EventTime = eventTime.UTC()
+}
+
+// the groups of fields a message updates together, each with the time of the
+// newest report that set them
+const (
+	fieldGroupIdentity = "identity"
+	fieldGroupPosition = "position"
+	fieldGroupVelocity = "velocity"
+	fieldGroupAltitude = "altitude"
+	fieldGroupStatus   = "status"
+)
+
+// fieldGroup returns the group of fields the message updates, empty when it
+// only tells the aircraft is around.
+func fieldGroup(message schema.ADSBMessage) string {
+	switch message.MessageType {
+	case schema.MessageTypeNewID, schema.MessageTypeSelectionChange:
+		return fieldGroupIdentity
+	case schema.MessageTypeStatusChange:
+		// a removal concerns the whole aircraft
+		if message.Status == schema.StatusRemoved || message.Status == schema.StatusDeleted {
+			return ""
+		}
+		return fieldGroupStatus
+	case schema.MessageTypeTransmission:
+	default:
+		return ""
+	}
+
+	switch message.TransmissionType {
+	case schema.TransmissionTypeIdentityAndCategory:
+		return fieldGroupIdentity
+	case schema.TranmissionTypeSurfacePosition, schema.TranmissionTypeAirbornePosition:
+		return fieldGroupPosition
+	case schema.TranmissionTypeAirborneVelocity:
+		return fieldGroupVelocity
+	case schema.TranmissionTypeSurveillanceAltitude:
+		return fieldGroupAltitude
+	default:
+		return ""
+	}
+}
+
+// eventTimes are the times of the newest reports stored for an aircraft, as
+// a whole and per group of fields.
+type eventTimes struct {
+	EventTime         time.Time `json:"event_time"`
+	IdentityEventTime time.Time `json:"identity_event_time"`
+	PositionEventTime time.Time `json:"position_event_time"`
+	VelocityEventTime time.Time `json:"velocity_event_time"`
+	AltitudeEventTime time.Time `json:"altitude_event_time"`
+	StatusEventTime   time.Time `json:"status_event_time"`
+}
+
+// parseEventTimes reads the times of the stored aircraft, they are all zero
+// when it is not stored.
+func parseEventTimes(storedMessage string) eventTimes {
+	var stored []eventTimes
+
+	err := json.Unmarshal([]byte(storedMessage), &stored)
+	if err != nil || len(stored) == 0 {
+		return eventTimes{}
+	}
+
+	return stored[0]
+}
+
+func (times eventTimes) of(group string) time.Time {
+	switch group {
+	case fieldGroupIdentity:
+		return times.IdentityEventTime
+	case fieldGroupPosition:
+		return times.PositionEventTime
+	case fieldGroupVelocity:
+		return times.VelocityEventTime
+	case fieldGroupAltitude:
+		return times.AltitudeEventTime
+	case fieldGroupStatus:
+		return times.StatusEventTime
+	default:
+		return times.EventTime
 	}
 }
 
-func (p *SBS1Processor) handleLocationMessage(message ADSBMessage) error {
-	writer := bufio.NewWriter(p.geoDB)
+func (p *SBS1Processor) handleLocationMessage(message schema.ADSBMessage) error {
+	if message.TransmissionType != schema.TranmissionTypeSurfacePosition && message.TransmissionType != schema.TranmissionTypeAirbornePosition {
+		return nil
+	}
 
-	if message.TransmissionType != TranmissionTypeSurfacePosition && message.TransmissionType != TranmissionTypeAirbornePosition {
+	if !message.Latitude.Valid || !message.Longitude.Valid {
 		return nil
 	}
 
-	if message.Latitude < -90 || message.Latitude > 90 || message.Longitude < -180 || message.Longitude > 180 {
+	latitude, longitude := message.Latitude.Value, message.Longitude.Value
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
 		return InvalidLocationCoordinates
 	}
 
-	write, err := writer.Write([]byte(fmt.Sprintf("SAVE mapofplanes %v %v %v\n", message.HexIdent, message.Latitude, message.Longitude)))
+	err := p.writeGeoDB(fmt.Sprintf("SAVE mapofplanes %v %v %v\n", message.HexIdent, latitude, longitude))
 	if err != nil {
 		log.Println("Failed to write to GeoDB", err)
 		return FailedToWriteToGeoDB
 	}
 
-	err = writer.Flush()
+	return nil
+}
 
-	if err != nil {
-		log.Println("Failed to flush to GeoDB", err)
-		return FailedToWriteToGeoDB
-	}
+// handleStatusMessage forgets the aircraft BaseStation removed, unless it was
+// heard from since, and records the other statuses so a lost aircraft can be
+// told apart from a live one.
+func (p *SBS1Processor) handleStatusMessage(message schema.ADSBMessage, stored bool, newest bool) error {
+	switch message.Status {
+	case schema.StatusRemoved, schema.StatusDeleted:
+		if !newest {
+			return nil
+		}
 
-	log.Println("Wrote to GeoDB", write)
+		err := p.redis.Del(p.ctx, message.HexIdent).Err()
+		if err != nil {
+			return fmt.Errorf("%w: %w", FailedToWriteToRedis, err)
+		}
+
+		err = p.writeGeoDB(fmt.Sprintf("DELETE mapofplanes %v\n", message.HexIdent))
+		if err != nil {
+			log.Println("Failed to delete from GeoDB", err)
+			return FailedToWriteToGeoDB
+		}
+	default:
+		// nothing to annotate for an aircraft not seen yet
+		if !stored {
+			return nil
+		}
+
+		err := p.set(message.HexIdent, ".status", message.Status)
+		if err != nil {
+			return err
+		}
+
+		return p.setEventTimes(message, fieldGroupStatus, false)
+	}
 
 	return nil
 }
 
-func (p *SBS1Processor) handleIdentityMessage(message ADSBMessage) error {
-	if message.TransmissionType != TransmissionTypeIdentityAndCategory {
+func (p *SBS1Processor) handleIdentityMessage(message schema.ADSBMessage) error {
+	isIdentity := message.MessageType == schema.MessageTypeNewID || message.MessageType == schema.MessageTypeSelectionChange
+	if message.TransmissionType != schema.TransmissionTypeIdentityAndCategory && !isIdentity {
 		return nil
 	}
 
-	p.redis.JSONSet(p.ctx, message.HexIdent, ".callsign", message.CallSign)
+	if message.CallSign == "" {
+		return nil
+	}
 
-	return nil
+	return p.set(message.HexIdent, ".callsign", message.CallSign)
 }
 
-func (p *SBS1Processor) handleVelocityMessage(message ADSBMessage) error {
-	if message.TransmissionType != TranmissionTypeAirborneVelocity {
-		return errors.New("invalid transmission type")
+func (p *SBS1Processor) handleVelocityMessage(message schema.ADSBMessage) error {
+	if message.TransmissionType != schema.TranmissionTypeAirborneVelocity {
+		return nil
 	}
 
-	p.redis.JSONSet(p.ctx, message.HexIdent, ".groundSpeed", message.GroundSpeed)
-	p.redis.JSONSet(p.ctx, message.HexIdent, ".track", message.Track)
-	p.redis.JSONSet(p.ctx, message.HexIdent, ".verticalRate", message.VerticalRate)
+	// absent fields keep the last known value
+	var err error
+	if message.GroundSpeed.Valid {
+		err = errors.Join(err, p.set(message.HexIdent, ".groundSpeed", message.GroundSpeed.Value))
+	}
+	if message.Track.Valid {
+		err = errors.Join(err, p.set(message.HexIdent, ".track", message.Track.Value))
+	}
+	if message.VerticalRate.Valid {
+		err = errors.Join(err, p.set(message.HexIdent, ".verticalRate", message.VerticalRate.Value))
+	}
 
-	return nil
+	return err
 }
 
-func (p *SBS1Processor) handleAltitudeMessage(message ADSBMessage) error {
-	if message.TransmissionType != TranmissionTypeSurveillanceAltitude {
-		return errors.New("invalid transmission type")
+func (p *SBS1Processor) handleAltitudeMessage(message schema.ADSBMessage) error {
+	if message.TransmissionType != schema.TranmissionTypeSurveillanceAltitude {
+		return nil
 	}
 
-	p.redis.JSONSet(p.ctx, message.HexIdent, ".altitude", message.Altitude)
+	if !message.Altitude.Valid {
+		return nil
+	}
 
-	return nil
+	return p.set(message.HexIdent, ".altitude", message.Altitude.Value)
 }
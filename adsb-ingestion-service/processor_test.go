@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+// fakeRedisJSON speaks enough RESP for the processor: JSON.GET and JSON.SET
+// on the root or a top level field, and DEL. Like RedisJSON it refuses values
+// that are not JSON. Other commands, the HELLO and CLIENT SETINFO go-redis
+// sends on connect included, get an error.
+type fakeRedisJSON struct {
+	mutex     sync.Mutex
+	documents map[string]map[string]any
+	listener  net.Listener
+	// when set, the error every command but PING is answered with
+	failure string
+}
+
+func newFakeRedisJSON(t testing.TB) *fakeRedisJSON {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeRedisJSON{documents: make(map[string]map[string]any), listener: listener}
+	go server.serve()
+	t.Cleanup(func() { _ = listener.Close() })
+
+	return server
+}
+
+func (server *fakeRedisJSON) serve() {
+	for {
+		connection, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer connection.Close()
+
+			reader := bufio.NewReader(connection)
+			for {
+				command, err := readCommand(reader)
+				if err != nil {
+					return
+				}
+
+				_, err = io.WriteString(connection, server.execute(command))
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	var count int
+	_, err := fmt.Fscanf(reader, "*%d\r\n", &count)
+	if err != nil {
+		return nil, err
+	}
+
+	command := make([]string, count)
+	for i := range command {
+		var length int
+		_, err = fmt.Fscanf(reader, "$%d\r\n", &length)
+		if err != nil {
+			return nil, err
+		}
+
+		argument := make([]byte, length+2)
+		_, err = io.ReadFull(reader, argument)
+		if err != nil {
+			return nil, err
+		}
+		command[i] = string(argument[:length])
+	}
+
+	return command, nil
+}
+
+func (server *fakeRedisJSON) execute(command []string) string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	switch {
+	case strings.EqualFold(command[0], "PING"):
+		return "+PONG\r\n"
+	case server.failure != "":
+		return "-" + server.failure + "\r\n"
+	case strings.EqualFold(command[0], "DEL"):
+		_, ok := server.documents[command[1]]
+		delete(server.documents, command[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case strings.EqualFold(command[0], "JSON.GET"):
+		document, ok := server.documents[command[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		reply, _ := json.Marshal([]any{document})
+		return "$" + strconv.Itoa(len(reply)) + "\r\n" + string(reply) + "\r\n"
+	case strings.EqualFold(command[0], "JSON.SET"):
+		var value any
+		if err := json.Unmarshal([]byte(command[3]), &value); err != nil {
+			return "-ERR expected value at line 1 column 1\r\n"
+		}
+
+		key, path := command[1], command[2]
+		if path == "$" {
+			document, ok := value.(map[string]any)
+			if !ok {
+				return "-ERR the root must be an object\r\n"
+			}
+			server.documents[key] = document
+			return "+OK\r\n"
+		}
+
+		document, ok := server.documents[key]
+		if !ok {
+			return "-ERR new objects must be created at the root\r\n"
+		}
+		document[strings.TrimPrefix(path, ".")] = value
+		return "+OK\r\n"
+	default:
+		return "-ERR unknown command '" + command[0] + "'\r\n"
+	}
+}
+
+func (server *fakeRedisJSON) get(key string, field string) (any, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	document, ok := server.documents[key]
+	if !ok {
+		return nil, false
+	}
+	value, ok := document[field]
+
+	return value, ok
+}
+
+// fakeGeoDB keeps the commands written to GeoDB.
+type fakeGeoDB struct {
+	mutex    sync.Mutex
+	commands []string
+}
+
+func (geoDB *fakeGeoDB) read(connection net.Conn) {
+	scanner := bufio.NewScanner(connection)
+	for scanner.Scan() {
+		geoDB.mutex.Lock()
+		geoDB.commands = append(geoDB.commands, scanner.Text())
+		geoDB.mutex.Unlock()
+	}
+}
+
+func (geoDB *fakeGeoDB) last() string {
+	geoDB.mutex.Lock()
+	defer geoDB.mutex.Unlock()
+
+	if len(geoDB.commands) == 0 {
+		return ""
+	}
+
+	return geoDB.commands[len(geoDB.commands)-1]
+}
+
+// testProcessor is a processor storing in a fake RedisJSON and GeoDB.
+func testProcessor(t testing.TB) (*SBS1Processor, *fakeRedisJSON, *fakeGeoDB) {
+	t.Helper()
+
+	redisServer := newFakeRedisJSON(t)
+	processor := NewSBS1Processor("", redisServer.listener.Addr().String(), make(chan Delivery))
+	err := processor.connectToRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	geoDB := &fakeGeoDB{}
+	client, server := net.Pipe()
+	processor.geoDB = client
+	go geoDB.read(server)
+
+	t.Cleanup(func() {
+		_ = processor.redis.Close()
+		_ = client.Close()
+	})
+
+	return processor, redisServer, geoDB
+}
+
+func sbs1Message(transmissionType int, eventTime time.Time) schema.ADSBMessage {
+	return schema.ADSBMessage{
+		MessageType:          schema.MessageTypeTransmission,
+		TransmissionType:     transmissionType,
+		HexIdent:             "4CA2D6",
+		DateMessageGenerated: eventTime.Format(schema.SBS1DateLayout),
+		TimeMessageGenerated: eventTime.Format("15:04:05.000"),
+		EventTime:            eventTime,
+	}
+}
+
+func TestProcessStoresAircraft(t *testing.T) {
+	processor, redisServer, geoDB := testProcessor(t)
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	altitude := sbs1Message(schema.TranmissionTypeSurveillanceAltitude, eventTime)
+	altitude.Altitude = schema.Some(35000.0)
+	identity := sbs1Message(schema.TransmissionTypeIdentityAndCategory, eventTime.Add(time.Second))
+	identity.CallSign = "KLM1023"
+	position := sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime.Add(2*time.Second))
+	position.Latitude, position.Longitude = schema.Some(52.3086), schema.Some(4.7639)
+	lost := sbs1Message(0, eventTime.Add(3*time.Second))
+	lost.MessageType, lost.Status = schema.MessageTypeStatusChange, schema.StatusSignalLost
+
+	// the first message stores the aircraft, the next ones update it
+	for _, message := range []schema.ADSBMessage{altitude, identity, position, lost} {
+		err := processor.process(message)
+		if err != nil {
+			t.Fatalf("%v %v: %v", message.MessageType, message.TransmissionType, err)
+		}
+	}
+
+	want := map[string]any{
+		"altitude":      35000.0,
+		"callsign":      "KLM1023",
+		"generatedDate": "2024/03/01",
+		"generatedTime": "10:00:02.000",
+		"event_time":    "2024-03-01T10:00:02Z",
+		"status":        schema.StatusSignalLost,
+	}
+	for field, value := range want {
+		stored, ok := redisServer.get("4CA2D6", field)
+		if !ok || stored != value {
+			t.Errorf("%v: got %v, want %v", field, stored, value)
+		}
+	}
+
+	// an older report changes nothing
+	late := sbs1Message(schema.TransmissionTypeIdentityAndCategory, eventTime)
+	late.CallSign = "KLM1024"
+	err := processor.process(late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callSign, _ := redisServer.get("4CA2D6", "callsign"); callSign != "KLM1023" {
+		t.Errorf("call sign %v, a late report overwrote it", callSign)
+	}
+
+	removed := sbs1Message(0, eventTime.Add(4*time.Second))
+	removed.MessageType, removed.Status = schema.MessageTypeStatusChange, schema.StatusRemoved
+	err = processor.process(removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := redisServer.get("4CA2D6", "altitude"); ok {
+		t.Error("removed aircraft still in Redis")
+	}
+
+	waitForGeoDB(t, geoDB, "DELETE mapofplanes 4CA2D6")
+}
+
+// waitForGeoDB waits for the command to be the last GeoDB received.
+func waitForGeoDB(t *testing.T, geoDB *fakeGeoDB, command string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for geoDB.last() != command && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if geoDB.last() != command {
+		t.Errorf("last GeoDB command %q, want %q", geoDB.last(), command)
+	}
+}
+
+func TestProcessSendsFirstPositionToGeoDB(t *testing.T) {
+	processor, redisServer, geoDB := testProcessor(t)
+
+	position := sbs1Message(schema.TranmissionTypeAirbornePosition, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	position.Latitude, position.Longitude = schema.Some(52.3086), schema.Some(4.7639)
+	err := processor.process(position)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := redisServer.get("4CA2D6", "hex_ident"); !ok {
+		t.Error("aircraft not stored")
+	}
+	waitForGeoDB(t, geoDB, "SAVE mapofplanes 4CA2D6 52.3086 4.7639")
+}
+
+func TestProcessStalenessPerFieldGroup(t *testing.T) {
+	processor, redisServer, geoDB := testProcessor(t)
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	first := sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime)
+	first.Latitude, first.Longitude = schema.Some(52.3), schema.Some(4.7)
+	altitude := sbs1Message(schema.TranmissionTypeSurveillanceAltitude, eventTime.Add(2*time.Second))
+	altitude.Altitude = schema.Some(35000.0)
+	// heard by a slower receiver, after the altitude but reported before it
+	position := sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime.Add(time.Second))
+	position.Latitude, position.Longitude = schema.Some(52.31), schema.Some(4.71)
+	late := sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime.Add(500*time.Millisecond))
+	late.Latitude, late.Longitude = schema.Some(52.305), schema.Some(4.705)
+
+	for _, message := range []schema.ADSBMessage{first, altitude, position} {
+		err := processor.process(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForGeoDB(t, geoDB, "SAVE mapofplanes 4CA2D6 52.31 4.71")
+
+	// the position is older than the newest position, not only the altitude
+	err := processor.process(late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	waitForGeoDB(t, geoDB, "SAVE mapofplanes 4CA2D6 52.31 4.71")
+
+	want := map[string]any{
+		"event_time":          "2024-03-01T10:00:02Z",
+		"position_event_time": "2024-03-01T10:00:01Z",
+		"altitude_event_time": "2024-03-01T10:00:02Z",
+		"generatedTime":       "10:00:02.000",
+	}
+	for field, value := range want {
+		stored, ok := redisServer.get("4CA2D6", field)
+		if !ok || stored != value {
+			t.Errorf("%v: got %v, want %v", field, stored, value)
+		}
+	}
+}
+
+func TestProcessWritesEventTimeLast(t *testing.T) {
+	processor, redisServer, _ := testProcessor(t)
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	err := processor.process(sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the position fails halfway, the event times must not move so a
+	// redelivery would be applied
+	position := sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime.Add(time.Second))
+	position.Latitude, position.Longitude = schema.Some(91.0), schema.Some(4.7)
+	err = processor.process(position)
+	if !errors.Is(err, InvalidLocationCoordinates) {
+		t.Fatalf("got %v, want InvalidLocationCoordinates", err)
+	}
+	for _, field := range []string{"event_time", "position_event_time"} {
+		if stored, _ := redisServer.get("4CA2D6", field); stored != "2024-03-01T10:00:00Z" {
+			t.Errorf("%v %v after a failed message", field, stored)
+		}
+	}
+}
+
+func TestProcessRetriesWhileRedisIsUnavailable(t *testing.T) {
+	processor, redisServer, _ := testProcessor(t)
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	for failure, retry := range map[string]bool{
+		"LOADING Redis is loading the dataset in memory":            true,
+		"READONLY You can't write against a read only replica.":     true,
+		"MASTERDOWN Link with MASTER is down":                       true,
+		"TRYAGAIN Multiple keys request during rehashing of slot":   true,
+		"CLUSTERDOWN The cluster is down":                           true,
+		"ERR new objects must be created at the root":               false,
+		"WRONGTYPE Operation against a key holding the wrong value": false,
+	} {
+		redisServer.mutex.Lock()
+		redisServer.failure = failure
+		redisServer.mutex.Unlock()
+
+		err := processor.process(sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime))
+		if err == nil {
+			t.Fatalf("%v: stored", failure)
+		}
+		if retryable(err) != retry {
+			t.Errorf("%v: retryable %v, want %v", failure, retryable(err), retry)
+		}
+	}
+}
+
+func TestProcessEvents(t *testing.T) {
+	processor, redisServer, geoDB := testProcessor(t)
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	event := func(messageType string, seconds int) schema.ADSBMessage {
+		message := sbs1Message(0, eventTime.Add(time.Duration(seconds)*time.Second))
+		message.MessageType = messageType
+		return message
+	}
+
+	// a status for an aircraft not seen yet has nothing to annotate
+	lost := event(schema.MessageTypeStatusChange, 0)
+	lost.Status = schema.StatusPositionLost
+	err := processor.process(lost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := redisServer.get("4CA2D6", "status"); ok {
+		t.Error("status stored for an unknown aircraft")
+	}
+
+	newAircraft := event(schema.MessageTypeNewAircraft, 1)
+	newID := event(schema.MessageTypeNewID, 2)
+	newID.CallSign = "KLM1023"
+	selection := event(schema.MessageTypeSelectionChange, 3)
+	selection.CallSign = "KLM1024"
+	// clicks are not stored, even without an aircraft
+	click := event(schema.MessageTypeClick, 4)
+	click.HexIdent = ""
+	lost = event(schema.MessageTypeStatusChange, 5)
+	lost.Status = schema.StatusPositionLost
+
+	for _, message := range []schema.ADSBMessage{newAircraft, newID, selection, click, lost} {
+		err = processor.process(message)
+		if err != nil {
+			t.Fatalf("%v: %v", message.MessageType, err)
+		}
+	}
+
+	if _, ok := redisServer.get("", "hex_ident"); ok {
+		t.Error("click stored")
+	}
+	want := map[string]any{
+		"hex_ident": "4CA2D6",
+		"callsign":  "KLM1024",
+		"status":    schema.StatusPositionLost,
+	}
+	for field, value := range want {
+		stored, ok := redisServer.get("4CA2D6", field)
+		if !ok || stored != value {
+			t.Errorf("%v: got %v, want %v", field, stored, value)
+		}
+	}
+
+	deleted := event(schema.MessageTypeStatusChange, 6)
+	deleted.Status = schema.StatusDeleted
+	err = processor.process(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := redisServer.get("4CA2D6", "hex_ident"); ok {
+		t.Error("deleted aircraft still in Redis")
+	}
+	waitForGeoDB(t, geoDB, "DELETE mapofplanes 4CA2D6")
+}
+
+// BenchmarkProcess measures storing a message of an aircraft already known,
+// on one worker. The service needs 120k messages a minute.
+func BenchmarkProcess(b *testing.B) {
+	processor, _, _ := testProcessor(b)
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	position := sbs1Message(schema.TranmissionTypeAirbornePosition, eventTime)
+	position.Latitude, position.Longitude = schema.Some(52.3086), schema.Some(4.7639)
+	err := processor.process(position)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		position.EventTime = eventTime.Add(time.Duration(i) * time.Millisecond)
+		err = processor.process(position)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Minutes(), "msg/min")
+}
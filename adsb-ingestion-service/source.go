@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+const (
+	SourceRabbitMQ = "rabbitmq"
+	SourceNATS     = "nats"
+)
+
+var (
+	InvalidSource = errors.New("invalid source")
+)
+
+// Source is where the service reads the messages from. StartListening
+// delivers them to the Messages channel, and acknowledges them once the
+// processor reports they were stored.
+type Source interface {
+	Connect() error
+	StartListening(workers int) error
+	Messages() chan Delivery
+	// Connected tells whether messages can be read, for health checks
+	Connected() bool
+	Close() error
+}
+
+// Delivery is a message handed to the processor, which reports with Done
+// whether it was stored.
+type Delivery struct {
+	Message schema.ADSBMessage
+	results chan<- error
+}
+
+func (d Delivery) Done(err error) {
+	d.results <- err
+}
+
+// pending is a delivery handed to the processor, its messages being stored.
+type pending struct {
+	results chan error
+	count   int
+}
+
+// dispatch hands the messages of a delivery to the processor. Sources call it
+// in the order the deliveries come, so the messages of an aircraft reach its
+// worker in that order, and only wait for the results concurrently.
+func dispatch(messages chan<- Delivery, batch []schema.ADSBMessage) pending {
+	results := make(chan error, len(batch))
+	for _, message := range batch {
+		messages <- Delivery{Message: message, results: results}
+	}
+
+	return pending{results: results, count: len(batch)}
+}
+
+// wait waits for all the messages of the delivery. A retryable failure wins
+// over another, the whole delivery is then tried again.
+func (p pending) wait() error {
+	var failure error
+	for range p.count {
+		err := <-p.results
+		if err != nil && (failure == nil || retryable(err)) {
+			failure = err
+		}
+	}
+
+	return failure
+}
+
+func checkSource(source string) (string, error) {
+	if source == "" {
+		return SourceRabbitMQ, nil
+	}
+
+	if source != SourceRabbitMQ && source != SourceNATS {
+		return "", InvalidSource
+	}
+
+	return source, nil
+}
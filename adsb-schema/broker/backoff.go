@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff spaces out reconnection attempts: the delay doubles on every attempt
+// up to Max, with jitter so receivers restarting together are not all redialed
+// at the same time. Max at 0 leaves the delay uncapped, MaxRetries at 0
+// retries forever.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	MaxRetries int
+}
+
+var DefaultBackoff = Backoff{
+	Initial: time.Second,
+	Max:     time.Minute,
+}
+
+// Delay returns how long to wait before the given attempt, counted from 1.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Initial
+	for i := 1; i < attempt && delay < math.MaxInt64/2; i++ {
+		if b.Max > 0 && delay >= b.Max {
+			break
+		}
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	// somewhere between half and the full delay
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// GivesUp tells whether the attempt is past the allowed retries.
+func (b Backoff) GivesUp(attempt int) bool {
+	return b.MaxRetries > 0 && attempt > b.MaxRetries
+}
@@ -0,0 +1,59 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Initial: time.Second, Max: 10 * time.Second}
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{64, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			delay := backoff.Delay(tt.attempt)
+			if delay < tt.want/2 || delay > tt.want {
+				t.Fatalf("attempt %d: %v, want between %v and %v", tt.attempt, delay, tt.want/2, tt.want)
+			}
+		}
+	}
+}
+
+func TestBackoffDelayUncapped(t *testing.T) {
+	// without a maximum the delay keeps doubling instead of dropping to 0
+	backoff := Backoff{Initial: time.Second}
+
+	if delay := backoff.Delay(8); delay < 64*time.Second || delay > 128*time.Second {
+		t.Errorf("attempt 8: %v", delay)
+	}
+	for _, attempt := range []int{40, 64, 1000} {
+		if delay := backoff.Delay(attempt); delay <= 0 {
+			t.Errorf("attempt %d: %v", attempt, delay)
+		}
+	}
+
+	if delay := (Backoff{}).Delay(3); delay != 0 {
+		t.Errorf("no initial delay: %v", delay)
+	}
+}
+
+func TestBackoffGivesUp(t *testing.T) {
+	if DefaultBackoff.GivesUp(1000) {
+		t.Error("the default gives up")
+	}
+
+	backoff := Backoff{MaxRetries: 3}
+	if backoff.GivesUp(3) || !backoff.GivesUp(4) {
+		t.Error("not giving up after the third retry")
+	}
+}
@@ -0,0 +1,25 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// the header holding the content type of a NATS message
+const NATSContentTypeHeader = "Content-Type"
+
+// NATSStreamConfig is the stream both the listener and the ingestion service
+// declare, with the limits of the RabbitMQ queue. The last one to start
+// overwrites what the other declared.
+func NATSStreamConfig(stream string, subject string) jetstream.StreamConfig {
+	return jetstream.StreamConfig{
+		Name:     stream,
+		Subjects: []string{subject + ".>"},
+		MaxAge:   5 * time.Second,
+		MaxMsgs:  500000,
+		MaxBytes: 2000000000,
+		Discard:  jetstream.DiscardOld,
+		Storage:  jetstream.FileStorage,
+	}
+}
@@ -0,0 +1,291 @@
+// Package broker is what the listener and the ingestion service must agree on
+// to reach each other through a message broker: how the RabbitMQ queue and
+// exchanges are declared.
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// queue types
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+)
+
+// what the queue does once it is full
+const (
+	OverflowDropHead         = "drop-head"
+	OverflowRejectPublish    = "reject-publish"
+	OverflowRejectPublishDLX = "reject-publish-dlx"
+)
+
+const (
+	ExchangeDirect = "direct"
+	ExchangeFanout = "fanout"
+	ExchangeTopic  = "topic"
+)
+
+var (
+	InvalidTopology  = errors.New("invalid queue topology")
+	TopologyMismatch = errors.New("queue topology does not match the broker")
+)
+
+// Topology is how the queue, and the exchange in front of it when there is
+// one, are declared. The listener and the ingestion service must declare the
+// same, RabbitMQ refuses to redeclare a queue or an exchange with other
+// settings: give both the same RABBITMQ_TOPOLOGY.
+//
+// With an exchange, messages are published with a routing key telling their
+// type, msg.{transmission_type} for MSG records and the lowercase record type
+// otherwise (sta, id...). A topic exchange can then route, e.g., only the
+// positions (msg.2, msg.3) to a queue.
+type Topology struct {
+	// milliseconds a message is kept, 0 keeps it until consumed
+	MessageTTL     int    `json:"message_ttl"`
+	MaxLength      int    `json:"max_length"`
+	MaxLengthBytes int64  `json:"max_length_bytes"`
+	Overflow       string `json:"overflow"`
+	QueueType      string `json:"queue_type"`
+	// empty publishes to the queue through the default exchange
+	Exchange     string `json:"exchange"`
+	ExchangeType string `json:"exchange_type"`
+	// the keys the queue is bound with, every message of a topic exchange
+	// when empty
+	RoutingKeys []string `json:"routing_keys"`
+	// where the records the listener cannot parse and the deliveries the
+	// ingestion service cannot process go, with the reason in their
+	// x-failure-reason header. The topic exchange routes them with the
+	// DeadLetter keys below, the queue gets them all. They are dropped when
+	// both are empty.
+	DeadLetterExchange string `json:"dead_letter_exchange"`
+	DeadLetterQueue    string `json:"dead_letter_queue"`
+}
+
+// routing keys of the dead letters on the dead letter exchange
+const (
+	// an SBS1 line the listener could not parse
+	DeadLetterSBS1 = "listener.sbs1"
+	// a delivery the ingestion service could not decode or store
+	DeadLetterDelivery = "ingestion.delivery"
+)
+
+// dead letter headers
+const (
+	HeaderFailureReason = "x-failure-reason"
+	HeaderFailedAt      = "x-failed-at"
+	// the queue a delivery was read from, where it can be replayed
+	HeaderOriginalQueue = "x-original-queue"
+	// the key the delivery was published with, it is replayed with it
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+	HeaderReceiver           = "x-receiver"
+	// how many times the ingestion service put a delivery back in its queue
+	// while the storage was unavailable
+	HeaderRetries = "x-retries"
+)
+
+// DefaultTopology is a classic queue keeping 500k messages for 5 seconds at
+// most, dropping the oldest past that.
+var DefaultTopology = Topology{
+	MessageTTL:     5000,
+	MaxLength:      500000,
+	MaxLengthBytes: 2000000000,
+	Overflow:       OverflowDropHead,
+	QueueType:      QueueTypeClassic,
+}
+
+// ParseTopology reads a topology given as JSON, inline or in the file it
+// names, e.g. {"exchange":"adsb","exchange_type":"topic","routing_keys":["msg.3"]}.
+// The fields left out keep their default.
+func ParseTopology(config string) (Topology, error) {
+	topology := DefaultTopology
+	if config == "" {
+		return topology, nil
+	}
+
+	data := []byte(config)
+	if !strings.HasPrefix(strings.TrimSpace(config), "{") {
+		var err error
+		data, err = os.ReadFile(config)
+		if err != nil {
+			return Topology{}, err
+		}
+	}
+
+	err := json.Unmarshal(data, &topology)
+	if err != nil {
+		return Topology{}, fmt.Errorf("%w: %v", InvalidTopology, err)
+	}
+
+	if topology.Exchange != "" && topology.ExchangeType == "" {
+		topology.ExchangeType = ExchangeDirect
+	}
+
+	err = topology.check()
+	if err != nil {
+		return Topology{}, err
+	}
+
+	return topology, nil
+}
+
+func (t Topology) check() error {
+	switch {
+	case t.MessageTTL < 0 || t.MaxLength < 0 || t.MaxLengthBytes < 0:
+		return fmt.Errorf("%w: negative limit", InvalidTopology)
+	case t.QueueType != QueueTypeClassic && t.QueueType != QueueTypeQuorum:
+		return fmt.Errorf("%w: unknown queue type %q", InvalidTopology, t.QueueType)
+	case t.Overflow != OverflowDropHead && t.Overflow != OverflowRejectPublish && t.Overflow != OverflowRejectPublishDLX:
+		return fmt.Errorf("%w: unknown overflow %q", InvalidTopology, t.Overflow)
+	case t.QueueType == QueueTypeQuorum && t.Overflow == OverflowRejectPublishDLX:
+		return fmt.Errorf("%w: quorum queues do not support %v", InvalidTopology, t.Overflow)
+	case t.Exchange == "" && (t.ExchangeType != "" || len(t.RoutingKeys) > 0):
+		return fmt.Errorf("%w: exchange type and routing keys need an exchange", InvalidTopology)
+	case t.Exchange != "" && t.ExchangeType != ExchangeDirect && t.ExchangeType != ExchangeFanout && t.ExchangeType != ExchangeTopic:
+		return fmt.Errorf("%w: unknown exchange type %q", InvalidTopology, t.ExchangeType)
+	case t.ExchangeType == ExchangeDirect && len(t.RoutingKeys) == 0:
+		return fmt.Errorf("%w: a direct exchange needs routing keys", InvalidTopology)
+	}
+
+	return nil
+}
+
+func (t Topology) queueArguments() amqp.Table {
+	args := make(amqp.Table)
+
+	if t.MessageTTL > 0 {
+		args["x-message-ttl"] = t.MessageTTL
+	}
+	if t.MaxLength > 0 {
+		args["x-max-length"] = t.MaxLength
+	}
+	if t.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = t.MaxLengthBytes
+	}
+	args["x-overflow"] = t.Overflow
+	// left out for classic queues, like the queues declared before it was
+	// configurable
+	if t.QueueType == QueueTypeQuorum {
+		args["x-queue-type"] = t.QueueType
+	}
+
+	return args
+}
+
+// Declare declares the exchange, the queues and their bindings. A mismatch with
+// what the broker already has is reported as TopologyMismatch.
+func (t Topology) Declare(channel *amqp.Channel, queue string) error {
+	if t.Exchange != "" {
+		err := channel.ExchangeDeclare(t.Exchange, t.ExchangeType, true, false, false, false, nil)
+		if err != nil {
+			return topologyError(err, "exchange", t.Exchange)
+		}
+	}
+
+	_, err := channel.QueueDeclare(queue, true, false, false, false, t.queueArguments())
+	if err != nil {
+		return topologyError(err, "queue", queue)
+	}
+
+	err = t.declareDeadLetters(channel)
+	if err != nil {
+		return err
+	}
+
+	if t.Exchange == "" {
+		return nil
+	}
+
+	keys := t.RoutingKeys
+	if len(keys) == 0 {
+		keys = []string{"#"}
+	}
+
+	for _, key := range keys {
+		err = channel.QueueBind(queue, key, t.Exchange, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t Topology) declareDeadLetters(channel *amqp.Channel) error {
+	if t.DeadLetterExchange != "" {
+		err := channel.ExchangeDeclare(t.DeadLetterExchange, ExchangeTopic, true, false, false, false, nil)
+		if err != nil {
+			return topologyError(err, "exchange", t.DeadLetterExchange)
+		}
+	}
+
+	if t.DeadLetterQueue == "" {
+		return nil
+	}
+
+	// no TTL nor length limit, dead letters are kept until looked at
+	_, err := channel.QueueDeclare(t.DeadLetterQueue, true, false, false, false, nil)
+	if err != nil {
+		return topologyError(err, "queue", t.DeadLetterQueue)
+	}
+
+	if t.DeadLetterExchange == "" {
+		return nil
+	}
+
+	return channel.QueueBind(t.DeadLetterQueue, "#", t.DeadLetterExchange, false, nil)
+}
+
+// DeadLetterTarget is the exchange and routing key a dead letter of the kind
+// is published with, ok is false when dead letters are dropped.
+func (t Topology) DeadLetterTarget(kind string) (exchange string, key string, ok bool) {
+	switch {
+	case t.DeadLetterExchange != "":
+		return t.DeadLetterExchange, kind, true
+	case t.DeadLetterQueue != "":
+		return "", t.DeadLetterQueue, true
+	default:
+		return "", "", false
+	}
+}
+
+// topologyError explains a PRECONDITION_FAILED, it means the broker has the
+// queue or exchange with other settings.
+func topologyError(err error, kind string, name string) error {
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return fmt.Errorf("%w: the %v %q exists with other settings, delete it or align RABBITMQ_TOPOLOGY on both services: %v", TopologyMismatch, kind, name, amqpErr.Reason)
+	}
+
+	return err
+}
+
+// RoutingKey is the key a message is published with.
+func (t Topology) RoutingKey(queue string, message schema.ADSBMessage) string {
+	if t.Exchange == "" {
+		return queue
+	}
+
+	if message.MessageType == schema.MessageTypeTransmission {
+		return "msg." + strconv.Itoa(message.TransmissionType)
+	}
+
+	return strings.ToLower(message.MessageType)
+}
+
+// Expiration is the per message expiration matching the queue TTL.
+func (t Topology) Expiration() string {
+	if t.MessageTTL == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(t.MessageTTL)
+}
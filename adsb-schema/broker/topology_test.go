@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTopologyCheck(t *testing.T) {
+	withExchange := func(exchangeType string, keys ...string) Topology {
+		topology := DefaultTopology
+		topology.Exchange = "adsb"
+		topology.ExchangeType = exchangeType
+		topology.RoutingKeys = keys
+		return topology
+	}
+	with := func(change func(*Topology)) Topology {
+		topology := DefaultTopology
+		change(&topology)
+		return topology
+	}
+
+	valid := map[string]Topology{
+		"default":               DefaultTopology,
+		"quorum":                with(func(t *Topology) { t.QueueType = QueueTypeQuorum; t.Overflow = OverflowRejectPublish }),
+		"classic reject to dlx": with(func(t *Topology) { t.Overflow = OverflowRejectPublishDLX }),
+		"no limits":             with(func(t *Topology) { t.MessageTTL, t.MaxLength, t.MaxLengthBytes = 0, 0, 0 }),
+		"topic, every message":  withExchange(ExchangeTopic),
+		"topic, positions":      withExchange(ExchangeTopic, "msg.2", "msg.3"),
+		"fanout":                withExchange(ExchangeFanout),
+		"direct with a key":     withExchange(ExchangeDirect, "msg.3"),
+		"dead letters in queue": with(func(t *Topology) { t.DeadLetterQueue = "adsb-dead" }),
+		"dead letters in topic": with(func(t *Topology) { t.DeadLetterExchange = "adsb-dead" }),
+	}
+	for name, topology := range valid {
+		if err := topology.check(); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+
+	invalid := map[string]Topology{
+		"negative ttl":           with(func(t *Topology) { t.MessageTTL = -1 }),
+		"negative length":        with(func(t *Topology) { t.MaxLength = -1 }),
+		"negative bytes":         with(func(t *Topology) { t.MaxLengthBytes = -1 }),
+		"unknown queue type":     with(func(t *Topology) { t.QueueType = "stream" }),
+		"unknown overflow":       with(func(t *Topology) { t.Overflow = "drop-tail" }),
+		"quorum reject to dlx":   with(func(t *Topology) { t.QueueType = QueueTypeQuorum; t.Overflow = OverflowRejectPublishDLX }),
+		"type without exchange":  with(func(t *Topology) { t.ExchangeType = ExchangeTopic }),
+		"keys without exchange":  with(func(t *Topology) { t.RoutingKeys = []string{"msg.3"} }),
+		"unknown exchange type":  withExchange("headers"),
+		"direct without any key": withExchange(ExchangeDirect),
+	}
+	for name, topology := range invalid {
+		if err := topology.check(); !errors.Is(err, InvalidTopology) {
+			t.Errorf("%v: got %v, want InvalidTopology", name, err)
+		}
+	}
+}
+
+func TestTopologyQueueArguments(t *testing.T) {
+	// what the queues were declared with before the topology was
+	// configurable, a broker holding one must accept it unchanged
+	want := amqp.Table{
+		"x-message-ttl":      5000,
+		"x-max-length":       500000,
+		"x-max-length-bytes": int64(2000000000),
+		"x-overflow":         OverflowDropHead,
+	}
+	assertTable(t, DefaultTopology.queueArguments(), want)
+
+	quorum := Topology{QueueType: QueueTypeQuorum, Overflow: OverflowRejectPublish}
+	assertTable(t, quorum.queueArguments(), amqp.Table{
+		"x-overflow":   OverflowRejectPublish,
+		"x-queue-type": QueueTypeQuorum,
+	})
+
+	// amqp encodes every argument, a type it does not know fails the declare
+	if err := DefaultTopology.queueArguments().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertTable(t *testing.T, got amqp.Table, want amqp.Table) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%v: got %v (%T), want %v (%T)", key, got[key], got[key], value, value)
+		}
+	}
+}
+
+func TestParseTopology(t *testing.T) {
+	topology, err := ParseTopology("")
+	if err != nil || topology.MessageTTL != DefaultTopology.MessageTTL || topology.Exchange != "" {
+		t.Fatalf("got %+v, %v, want the default", topology, err)
+	}
+
+	// the fields left out keep their default, a named exchange is direct
+	topology, err = ParseTopology(`{"exchange":"adsb","routing_keys":["msg.3"],"message_ttl":1000}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topology.ExchangeType != ExchangeDirect || topology.MessageTTL != 1000 || topology.MaxLength != DefaultTopology.MaxLength {
+		t.Fatalf("got %+v", topology)
+	}
+
+	file := filepath.Join(t.TempDir(), "topology.json")
+	err = os.WriteFile(file, []byte(`{"queue_type":"quorum","overflow":"reject-publish"}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topology, err = ParseTopology(file)
+	if err != nil || topology.QueueType != QueueTypeQuorum {
+		t.Fatalf("got %+v, %v", topology, err)
+	}
+
+	for _, config := range []string{`{"message_ttl":"5s"}`, `{"exchange":"adsb"}`, `{"queue_type":"stream"}`} {
+		if _, err := ParseTopology(config); !errors.Is(err, InvalidTopology) {
+			t.Errorf("%v: got %v, want InvalidTopology", config, err)
+		}
+	}
+}
+
+func TestTopologyRoutingKey(t *testing.T) {
+	position := schema.ADSBMessage{MessageType: schema.MessageTypeTransmission, TransmissionType: 3}
+	status := schema.ADSBMessage{MessageType: schema.MessageTypeStatusChange}
+
+	if key := DefaultTopology.RoutingKey("sbs1", position); key != "sbs1" {
+		t.Errorf("without exchange: got %v, want the queue", key)
+	}
+
+	topic := Topology{Exchange: "adsb", ExchangeType: ExchangeTopic}
+	if key := topic.RoutingKey("sbs1", position); key != "msg.3" {
+		t.Errorf("position: got %v, want msg.3", key)
+	}
+	if key := topic.RoutingKey("sbs1", status); key != "sta" {
+		t.Errorf("status: got %v, want sta", key)
+	}
+}
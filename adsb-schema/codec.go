@@ -0,0 +1,95 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+)
+
+// how the messages are encoded on the wire
+const (
+	WireFormatJSON   = "json"
+	WireFormatBinary = "binary"
+)
+
+// media type of the binary wire format, its version is a parameter
+const mediaTypeBinary = "application/x-adsb"
+
+var (
+	UnsupportedContentType   = errors.New("unsupported content type")
+	UnsupportedSchemaVersion = errors.New("unsupported schema version")
+)
+
+// Encode encodes the messages in the wire format and returns the content type
+// that tells readers how to decode them. It sets the SchemaVersion of the
+// messages.
+func Encode(format string, messages []ADSBMessage) (string, []byte, error) {
+	for i := range messages {
+		messages[i].SchemaVersion = SchemaVersion
+	}
+
+	if format == WireFormatBinary {
+		return ContentTypeBinary, EncodeBinary(messages), nil
+	}
+
+	// a single message is sent on its own, for readers that do not know
+	// batches
+	if len(messages) == 1 {
+		body, err := json.Marshal(messages[0])
+		return ContentTypeMessage, body, err
+	}
+
+	body, err := json.Marshal(messages)
+	return ContentTypeBatch, body, err
+}
+
+// IsBinary tells whether the content type is of the binary wire format, in any
+// version.
+func IsBinary(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	return err == nil && mediaType == mediaTypeBinary
+}
+
+// Decode unpacks the messages of a body, in any of the formats Encode
+// writes: a JSON batch or a single JSON message, or binary.
+func Decode(contentType string, body []byte) ([]ADSBMessage, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil && contentType != "" {
+		return nil, fmt.Errorf("%w: %v", UnsupportedContentType, contentType)
+	}
+
+	var messages []ADSBMessage
+	switch mediaType {
+	case "", "text/plain", "application/json":
+		var message ADSBMessage
+		err = json.Unmarshal(body, &message)
+		messages = []ADSBMessage{message}
+	case mediaTypeBinary:
+		switch params["version"] {
+		case "1":
+			messages, err = decodeBinaryV1(body)
+		case strconv.Itoa(binaryVersion):
+			messages, err = DecodeBinary(body)
+		default:
+			return nil, fmt.Errorf("%w: %v", UnsupportedContentType, contentType)
+		}
+	case ContentTypeBatch:
+		err = json.Unmarshal(body, &messages)
+	default:
+		return nil, fmt.Errorf("%w: %v", UnsupportedContentType, contentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, message := range messages {
+		if message.SchemaVersion > SchemaVersion {
+			return nil, fmt.Errorf("%w: %v, this reader knows up to %v", UnsupportedSchemaVersion, message.SchemaVersion, SchemaVersion)
+		}
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,82 @@
+package schema
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// sampleMessages are airborne positions of a few aircraft, as the listener
+// sends them.
+func sampleMessages(n int) []ADSBMessage {
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	messages := make([]ADSBMessage, n)
+	for i := range messages {
+		messages[i] = ADSBMessage{
+			MessageType:          MessageTypeTransmission,
+			TransmissionType:     TranmissionTypeAirbornePosition,
+			SessionId:            "1",
+			AircraftId:           "1",
+			HexIdent:             fmt.Sprintf("%06X", 0x400000+i%50),
+			FlightId:             "1",
+			DateMessageGenerated: "2024/03/01",
+			TimeMessageGenerated: "10:00:00.000",
+			DateMessageLogged:    "2024/03/01",
+			TimeMessageLogged:    "10:00:00.000",
+			Altitude:             Some(35000.0),
+			Latitude:             Some(52.3086),
+			Longitude:            Some(4.7639),
+			Alert:                Some(false),
+			Emergency:            Some(false),
+			Spi:                  Some(false),
+			IsOnGround:           Some(false),
+			EventTime:            eventTime,
+			IngestTime:           eventTime.Add(time.Second),
+		}
+	}
+
+	return messages
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, format := range []string{WireFormatJSON, WireFormatBinary} {
+		for _, batchSize := range []int{1, 100} {
+			b.Run(fmt.Sprintf("%v/batch-%d", format, batchSize), func(b *testing.B) {
+				messages := sampleMessages(batchSize)
+
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, _, err := Encode(format, messages)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*batchSize), "ns/msg")
+			})
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, format := range []string{WireFormatJSON, WireFormatBinary} {
+		for _, batchSize := range []int{1, 100} {
+			b.Run(fmt.Sprintf("%v/batch-%d", format, batchSize), func(b *testing.B) {
+				contentType, body, err := Encode(format, sampleMessages(batchSize))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_, err := Decode(contentType, body)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*batchSize), "ns/msg")
+			})
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package schema
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// go test -update rewrites the golden files, only do so along with a new
+// SchemaVersion or wire format version: readers deployed with the old files
+// must still read what is sent.
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// fullMessage carries every field, so a field added, renamed or encoded
+// differently changes the golden files.
+func fullMessage() ADSBMessage {
+	eventTime := time.Date(2024, 3, 1, 10, 0, 0, 123000000, time.UTC)
+
+	return ADSBMessage{
+		MessageType:          MessageTypeTransmission,
+		TransmissionType:     TranmissionTypeAirbornePosition,
+		SessionId:            "1",
+		AircraftId:           "2",
+		HexIdent:             "4CA2D6",
+		FlightId:             "3",
+		DateMessageGenerated: "2024/03/01",
+		TimeMessageGenerated: "10:00:00.123",
+		DateMessageLogged:    "2024/03/01",
+		TimeMessageLogged:    "10:00:00.125",
+		CallSign:             "KLM1023",
+		Altitude:             Some(35000.0),
+		GroundSpeed:          Some(451.5),
+		Track:                Some(92),
+		Latitude:             Some(52.3086),
+		Longitude:            Some(4.7639),
+		VerticalRate:         Some(-64.0),
+		Squawk:               "1000",
+		Alert:                Some(false),
+		Emergency:            Some(true),
+		Spi:                  Some(false),
+		IsOnGround:           Some(false),
+		Status:               StatusOK,
+		EventTime:            eventTime,
+		IngestTime:           eventTime.Add(time.Second),
+		RawFrame:             "8D4CA2D658C901E090F1E6A1C4A8",
+		FrameTimestamp:       1234567890,
+		SignalLevel:          Some(0.25),
+		EmitterCategory:      "A3",
+		GeometricAltitude:    Some(35150.0),
+		NIC:                  8,
+		NACp:                 9,
+		ReceiverId:           "north/1",
+		ReceiverCount:        2,
+		Receivers:            []string{"north/1", "south"},
+	}
+}
+
+// sparseMessage is a status record, with the optional fields absent.
+func sparseMessage() ADSBMessage {
+	return ADSBMessage{
+		MessageType: MessageTypeStatusChange,
+		HexIdent:    "3C6444",
+		Status:      StatusRemoved,
+		EventTime:   time.Date(2024, 3, 1, 10, 0, 1, 0, time.UTC),
+	}
+}
+
+func TestGoldenEncoding(t *testing.T) {
+	tests := []struct {
+		golden      string
+		format      string
+		messages    []ADSBMessage
+		contentType string
+	}{
+		{"message-v2.json", WireFormatJSON, []ADSBMessage{fullMessage()}, ContentTypeMessage},
+		{"batch-v2.json", WireFormatJSON, []ADSBMessage{fullMessage(), sparseMessage()}, ContentTypeBatch},
+		{"batch-v2.bin", WireFormatBinary, []ADSBMessage{fullMessage(), sparseMessage()}, ContentTypeBinary},
+	}
+
+	for _, test := range tests {
+		t.Run(test.golden, func(t *testing.T) {
+			file := filepath.Join("testdata", test.golden)
+
+			contentType, body, err := Encode(test.format, test.messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != test.contentType {
+				t.Fatalf("content type %q, want %q", contentType, test.contentType)
+			}
+			if *update {
+				err = os.WriteFile(file, body, 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			golden, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// what the listener sends
+			if !bytes.Equal(body, golden) {
+				t.Errorf("encoding changed, bump SchemaVersion if readers would get it wrong\ngot  %q\nwant %q", body, golden)
+			}
+
+			// what the ingestion service reads
+			decoded, err := Decode(test.contentType, golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, test.messages) {
+				t.Errorf("decoding changed\ngot  %+v\nwant %+v", decoded, test.messages)
+			}
+		})
+	}
+}
+
+// TestDecodeVersion1 reads what listeners of the first version still send.
+func TestDecodeVersion1(t *testing.T) {
+	tests := []struct {
+		golden      string
+		contentType string
+		messages    []ADSBMessage
+	}{
+		{"message-v1.json", ContentTypeMessage, []ADSBMessage{fullMessage()}},
+		{"batch-v1.json", ContentTypeBatch, []ADSBMessage{fullMessage(), sparseMessage()}},
+		{"batch-v1.bin", "application/x-adsb; version=1", []ADSBMessage{fullMessage(), sparseMessage()}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.golden, func(t *testing.T) {
+			for i := range test.messages {
+				test.messages[i].SchemaVersion = 1
+			}
+
+			golden, err := os.ReadFile(filepath.Join("testdata", test.golden))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := Decode(test.contentType, golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, test.messages) {
+				t.Errorf("got  %+v\nwant %+v", decoded, test.messages)
+			}
+		})
+	}
+}
+
+func TestBinaryVersionByte(t *testing.T) {
+	v1, err := os.ReadFile(filepath.Join("testdata", "batch-v1.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a body of another version read as the current one
+	_, err = Decode(ContentTypeBinary, v1)
+	if !errors.Is(err, InvalidBinaryMessage) {
+		t.Errorf("version 1 body: got %v, want InvalidBinaryMessage", err)
+	}
+	_, err = Decode(ContentTypeBinary, nil)
+	if !errors.Is(err, InvalidBinaryMessage) {
+		t.Errorf("empty body: got %v, want InvalidBinaryMessage", err)
+	}
+
+	if !IsBinary(ContentTypeBinary) || !IsBinary("application/x-adsb; version=1") || IsBinary(ContentTypeBatch) || IsBinary("") {
+		t.Error("binary content types not told apart")
+	}
+}
+
+func TestZeroIsNotAbsent(t *testing.T) {
+	// 0 dBFS is the strongest signal, 0 ft a geometric altitude at sea level
+	zero := sparseMessage()
+	zero.SignalLevel = Some(0.0)
+	zero.GeometricAltitude = Some(0.0)
+
+	for _, format := range []string{WireFormatJSON, WireFormatBinary} {
+		contentType, body, err := Encode(format, []ADSBMessage{zero, sparseMessage()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := Decode(contentType, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded[0].SignalLevel != Some(0.0) || decoded[0].GeometricAltitude != Some(0.0) {
+			t.Errorf("%v: zero read as %v %v", format, decoded[0].SignalLevel, decoded[0].GeometricAltitude)
+		}
+		if decoded[1].SignalLevel.Valid || decoded[1].GeometricAltitude.Valid {
+			t.Errorf("%v: absent read as %v %v", format, decoded[1].SignalLevel, decoded[1].GeometricAltitude)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{WireFormatJSON, WireFormatBinary} {
+		for _, messages := range [][]ADSBMessage{{fullMessage()}, {sparseMessage()}, {fullMessage(), sparseMessage(), fullMessage()}} {
+			contentType, body, err := Encode(format, messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := Decode(contentType, body)
+			if err != nil {
+				t.Fatalf("%v: %v", format, err)
+			}
+			if !reflect.DeepEqual(decoded, messages) {
+				t.Errorf("%v: got %+v, want %+v", format, decoded, messages)
+			}
+		}
+	}
+}
+
+func TestDecodeRejectsNewerSchema(t *testing.T) {
+	newer := fullMessage()
+	newer.SchemaVersion = SchemaVersion + 1
+
+	_, single, err := Encode(WireFormatJSON, []ADSBMessage{fullMessage()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Encode stamps the current version, write the newer one by hand
+	current := fmt.Sprintf(`"schema_version":%d`, SchemaVersion)
+	single = bytes.Replace(single, []byte(current), []byte(fmt.Sprintf(`"schema_version":%d`, newer.SchemaVersion)), 1)
+	_, err = Decode(ContentTypeMessage, single)
+	if !errors.Is(err, UnsupportedSchemaVersion) {
+		t.Errorf("single message: got %v, want UnsupportedSchemaVersion", err)
+	}
+
+	batch := []byte(fmt.Sprintf(`[{%v,"message_type":"MSG"},{"schema_version":%d,"message_type":"MSG"}]`, current, newer.SchemaVersion))
+	_, err = Decode(ContentTypeBatch, batch)
+	if !errors.Is(err, UnsupportedSchemaVersion) {
+		t.Errorf("batch: got %v, want UnsupportedSchemaVersion", err)
+	}
+
+	// the version of the binary format is in its content type
+	_, err = Decode(fmt.Sprintf("application/x-adsb; version=%d", binaryVersion+1), EncodeBinary([]ADSBMessage{newer}))
+	if !errors.Is(err, UnsupportedContentType) {
+		t.Errorf("binary: got %v, want UnsupportedContentType", err)
+	}
+
+	// listeners older than the schema version send none
+	messages, err := Decode("application/json", []byte(`{"message_type":"MSG","hex_ident":"4CA2D6","altitude":35000}`))
+	if err != nil || messages[0].SchemaVersion != 0 || messages[0].Altitude != Some(35000.0) {
+		t.Errorf("got %+v, %v", messages, err)
+	}
+}
@@ -0,0 +1,144 @@
+// Package schema is the message the listener sends and the ingestion service
+// reads, and how it is encoded on the wire. Both services build against it,
+// a change here reaches both at once.
+package schema
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// SchemaVersion is the version of ADSBMessage. It goes up with any change a
+// reader built against the previous one would get wrong, readers refuse the
+// messages of a version they do not know. Version 2 tells a signal level or a
+// geometric altitude of 0 from an unknown one.
+const SchemaVersion = 2
+
+const (
+	MessageTypeSelectionChange = "SEL"
+	MessageTypeNewID           = "ID"
+	MessageTypeNewAircraft     = "AIR"
+	MessageTypeStatusChange    = "STA"
+	MessageTypeClick           = "CLK"
+	MessageTypeTransmission    = "MSG"
+	// MessageTypeRaw marks a message built from a raw Mode-S frame that has no
+	// SBS1 equivalent.
+	MessageTypeRaw = "RAW"
+)
+
+const (
+	TransmissionTypeIdentityAndCategory = 1
+	TranmissionTypeSurfacePosition      = 2
+	TranmissionTypeAirbornePosition     = 3
+	TranmissionTypeAirborneVelocity     = 4
+	TranmissionTypeSurveillanceAltitude = 5
+	TranmissionTypeSurveillanceId       = 6
+	TranmissionTypeAirToAir             = 7
+	TranmissionTypeAllCallReply         = 8
+)
+
+// statuses of the STA records
+const (
+	StatusPositionLost = "PL"
+	StatusSignalLost   = "SL"
+	StatusRemoved      = "RM"
+	StatusDeleted      = "AD"
+	StatusOK           = "OK"
+)
+
+// content types of the AMQP messages: a single JSON message, a JSON array of
+// them, or any number of them in the binary wire format
+const (
+	ContentTypeMessage = "text/plain"
+	ContentTypeBatch   = "application/x-adsb-batch+json"
+	ContentTypeBinary  = "application/x-adsb; version=2"
+)
+
+const (
+	SBS1DateLayout = "2006/01/02"
+	SBS1TimeLayout = "15:04:05.000"
+)
+
+// ParseSBS1Time reads the date and time fields of an SBS1 record, written in
+// the receiver timezone. Feeds are not consistent with the fraction digits so
+// any number of them is accepted.
+func ParseSBS1Time(date string, clock string, location *time.Location) (time.Time, error) {
+	return time.ParseInLocation(SBS1DateLayout+" 15:04:05.999999999", date+" "+clock, location)
+}
+
+// Optional is a field a message may not carry. It is encoded as null when
+// absent, so an unknown altitude is not read as 0 ft.
+type Optional[T any] struct {
+	Value T
+	Valid bool
+}
+
+func Some[T any](value T) Optional[T] {
+	return Optional[T]{Value: value, Valid: true}
+}
+
+func (optional Optional[T]) MarshalJSON() ([]byte, error) {
+	if !optional.Valid {
+		return []byte("null"), nil
+	}
+
+	return json.Marshal(optional.Value)
+}
+
+func (optional *Optional[T]) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*optional = Optional[T]{}
+		return nil
+	}
+
+	err := json.Unmarshal(data, &optional.Value)
+	if err != nil {
+		return err
+	}
+	optional.Valid = true
+
+	return nil
+}
+
+type ADSBMessage struct {
+	// SchemaVersion is set by Encode, 0 for messages of listeners older than
+	// the versioning
+	SchemaVersion        int               `json:"schema_version,omitempty"`
+	MessageType          string            `json:"message_type"`
+	TransmissionType     int               `json:"transmission_type"`
+	SessionId            string            `json:"session_id"`
+	AircraftId           string            `json:"aircraft_id"`
+	HexIdent             string            `json:"hex_ident"`
+	FlightId             string            `json:"flight_id"`
+	DateMessageGenerated string            `json:"date_message_generated"`
+	TimeMessageGenerated string            `json:"time_message_generated"`
+	DateMessageLogged    string            `json:"date_message_logged"`
+	TimeMessageLogged    string            `json:"time_message_logged"`
+	CallSign             string            `json:"call_sign"`
+	Altitude             Optional[float64] `json:"altitude"`
+	GroundSpeed          Optional[float64] `json:"ground_speed"`
+	Track                Optional[int]     `json:"track"`
+	Latitude             Optional[float64] `json:"latitude"`
+	Longitude            Optional[float64] `json:"longitude"`
+	VerticalRate         Optional[float64] `json:"vertical_rate"`
+	Squawk               string            `json:"squawk"`
+	Alert                Optional[bool]    `json:"alert"`
+	Emergency            Optional[bool]    `json:"emergency"`
+	Spi                  Optional[bool]    `json:"spi"`
+	IsOnGround           Optional[bool]    `json:"is_on_ground"`
+	Status               string            `json:"status,omitempty"`
+	// EventTime is when the receiver generated the report, IngestTime when
+	// the listener read it
+	EventTime         time.Time         `json:"event_time"`
+	IngestTime        time.Time         `json:"ingest_time"`
+	RawFrame          string            `json:"raw_frame,omitempty"`
+	FrameTimestamp    uint64            `json:"frame_timestamp,omitempty"`
+	SignalLevel       Optional[float64] `json:"signal_level"`
+	EmitterCategory   string            `json:"emitter_category,omitempty"`
+	GeometricAltitude Optional[float64] `json:"geometric_altitude"`
+	NIC               int               `json:"nic,omitempty"`
+	NACp              int               `json:"nacp,omitempty"`
+	ReceiverId        string            `json:"receiver_id,omitempty"`
+	ReceiverCount     int               `json:"receiver_count,omitempty"`
+	Receivers         []string          `json:"receivers,omitempty"`
+}
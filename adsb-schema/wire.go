@@ -0,0 +1,411 @@
+package schema
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// The binary wire format, version 2, is a version byte followed by a uvarint
+// count of messages and the messages. Each message starts with a uvarint mask
+// of the fields it carries, in the order below, followed by these fields only:
+//   - strings: uvarint length and bytes
+//   - integers: zigzag varint, the frame timestamp a uvarint
+//   - floats: 8 bytes little endian IEEE 754
+//   - flags: a byte, 0 or 1
+//   - times: zigzag varint of nanoseconds since the Unix epoch
+//   - receivers: uvarint count of strings
+//
+// Empty strings, zero integers, zero times and absent optional fields are left
+// out. New fields take the next bit and need a new version, the version of the
+// wire format implies the SchemaVersion of its messages. The content type
+// carries the version too, the byte catches a body read with the wrong one.
+//
+// Version 1 has no version byte, and leaves out a signal level or geometric
+// altitude of 0. It is still read.
+const binaryVersion = 2
+
+const (
+	fieldMessageType = iota
+	fieldTransmissionType
+	fieldSessionId
+	fieldAircraftId
+	fieldHexIdent
+	fieldFlightId
+	fieldDateMessageGenerated
+	fieldTimeMessageGenerated
+	fieldDateMessageLogged
+	fieldTimeMessageLogged
+	fieldCallSign
+	fieldAltitude
+	fieldGroundSpeed
+	fieldTrack
+	fieldLatitude
+	fieldLongitude
+	fieldVerticalRate
+	fieldSquawk
+	fieldAlert
+	fieldEmergency
+	fieldSpi
+	fieldIsOnGround
+	fieldStatus
+	fieldEventTime
+	fieldIngestTime
+	fieldRawFrame
+	fieldFrameTimestamp
+	fieldSignalLevel
+	fieldEmitterCategory
+	fieldGeometricAltitude
+	fieldNIC
+	fieldNACp
+	fieldReceiverId
+	fieldReceiverCount
+	fieldReceivers
+	fieldCount
+)
+
+var (
+	InvalidBinaryMessage = errors.New("invalid binary message")
+)
+
+// EncodeBinary encodes the messages in the binary wire format.
+func EncodeBinary(messages []ADSBMessage) []byte {
+	body := binary.AppendUvarint([]byte{binaryVersion}, uint64(len(messages)))
+
+	var encoder binaryEncoder
+	for _, message := range messages {
+		encoder.mask = 0
+		encoder.fields = encoder.fields[:0]
+		encoder.message(message)
+
+		body = binary.AppendUvarint(body, encoder.mask)
+		body = append(body, encoder.fields...)
+	}
+
+	return body
+}
+
+// DecodeBinary decodes a body in the binary wire format.
+func DecodeBinary(body []byte) ([]ADSBMessage, error) {
+	if len(body) == 0 || body[0] != binaryVersion {
+		return nil, fmt.Errorf("%w: not version %v", InvalidBinaryMessage, binaryVersion)
+	}
+
+	return decodeBinary(body[1:], SchemaVersion)
+}
+
+// decodeBinaryV1 decodes a body of the first version, without a version byte.
+func decodeBinaryV1(body []byte) ([]ADSBMessage, error) {
+	return decodeBinary(body, 1)
+}
+
+func decodeBinary(body []byte, schemaVersion int) ([]ADSBMessage, error) {
+	decoder := binaryDecoder{data: body, schemaVersion: schemaVersion}
+
+	count := decoder.uvarint()
+	// every message takes at least a byte, do not trust the count further
+	if decoder.err == nil && count > uint64(len(decoder.data)) {
+		return nil, InvalidBinaryMessage
+	}
+
+	messages := make([]ADSBMessage, 0, count)
+	for i := uint64(0); i < count && decoder.err == nil; i++ {
+		decoder.mask = decoder.uvarint()
+		if decoder.mask>>fieldCount != 0 {
+			return nil, InvalidBinaryMessage
+		}
+
+		messages = append(messages, decoder.message())
+	}
+
+	if decoder.err != nil {
+		return nil, decoder.err
+	}
+	if len(decoder.data) != 0 {
+		return nil, InvalidBinaryMessage
+	}
+
+	return messages, nil
+}
+
+type binaryEncoder struct {
+	mask   uint64
+	fields []byte
+}
+
+func (e *binaryEncoder) message(message ADSBMessage) {
+	e.string(fieldMessageType, message.MessageType)
+	e.int(fieldTransmissionType, int64(message.TransmissionType))
+	e.string(fieldSessionId, message.SessionId)
+	e.string(fieldAircraftId, message.AircraftId)
+	e.string(fieldHexIdent, message.HexIdent)
+	e.string(fieldFlightId, message.FlightId)
+	e.string(fieldDateMessageGenerated, message.DateMessageGenerated)
+	e.string(fieldTimeMessageGenerated, message.TimeMessageGenerated)
+	e.string(fieldDateMessageLogged, message.DateMessageLogged)
+	e.string(fieldTimeMessageLogged, message.TimeMessageLogged)
+	e.string(fieldCallSign, message.CallSign)
+	e.float(fieldAltitude, message.Altitude.Value, message.Altitude.Valid)
+	e.float(fieldGroundSpeed, message.GroundSpeed.Value, message.GroundSpeed.Valid)
+	if message.Track.Valid {
+		e.set(fieldTrack)
+		e.fields = binary.AppendVarint(e.fields, int64(message.Track.Value))
+	}
+	e.float(fieldLatitude, message.Latitude.Value, message.Latitude.Valid)
+	e.float(fieldLongitude, message.Longitude.Value, message.Longitude.Valid)
+	e.float(fieldVerticalRate, message.VerticalRate.Value, message.VerticalRate.Valid)
+	e.string(fieldSquawk, message.Squawk)
+	e.flag(fieldAlert, message.Alert)
+	e.flag(fieldEmergency, message.Emergency)
+	e.flag(fieldSpi, message.Spi)
+	e.flag(fieldIsOnGround, message.IsOnGround)
+	e.string(fieldStatus, message.Status)
+	e.time(fieldEventTime, message.EventTime)
+	e.time(fieldIngestTime, message.IngestTime)
+	e.string(fieldRawFrame, message.RawFrame)
+	if message.FrameTimestamp != 0 {
+		e.set(fieldFrameTimestamp)
+		e.fields = binary.AppendUvarint(e.fields, message.FrameTimestamp)
+	}
+	e.float(fieldSignalLevel, message.SignalLevel.Value, message.SignalLevel.Valid)
+	e.string(fieldEmitterCategory, message.EmitterCategory)
+	e.float(fieldGeometricAltitude, message.GeometricAltitude.Value, message.GeometricAltitude.Valid)
+	e.int(fieldNIC, int64(message.NIC))
+	e.int(fieldNACp, int64(message.NACp))
+	e.string(fieldReceiverId, message.ReceiverId)
+	e.int(fieldReceiverCount, int64(message.ReceiverCount))
+	if len(message.Receivers) > 0 {
+		e.set(fieldReceivers)
+		e.fields = binary.AppendUvarint(e.fields, uint64(len(message.Receivers)))
+		for _, receiver := range message.Receivers {
+			e.fields = binary.AppendUvarint(e.fields, uint64(len(receiver)))
+			e.fields = append(e.fields, receiver...)
+		}
+	}
+}
+
+func (e *binaryEncoder) set(field int) {
+	e.mask |= 1 << field
+}
+
+func (e *binaryEncoder) string(field int, value string) {
+	if value == "" {
+		return
+	}
+
+	e.set(field)
+	e.fields = binary.AppendUvarint(e.fields, uint64(len(value)))
+	e.fields = append(e.fields, value...)
+}
+
+func (e *binaryEncoder) int(field int, value int64) {
+	if value == 0 {
+		return
+	}
+
+	e.set(field)
+	e.fields = binary.AppendVarint(e.fields, value)
+}
+
+func (e *binaryEncoder) float(field int, value float64, present bool) {
+	if !present {
+		return
+	}
+
+	e.set(field)
+	e.fields = binary.LittleEndian.AppendUint64(e.fields, math.Float64bits(value))
+}
+
+func (e *binaryEncoder) flag(field int, value Optional[bool]) {
+	if !value.Valid {
+		return
+	}
+
+	e.set(field)
+	if value.Value {
+		e.fields = append(e.fields, 1)
+	} else {
+		e.fields = append(e.fields, 0)
+	}
+}
+
+func (e *binaryEncoder) time(field int, value time.Time) {
+	if value.IsZero() {
+		return
+	}
+
+	e.set(field)
+	e.fields = binary.AppendVarint(e.fields, value.UnixNano())
+}
+
+// binaryDecoder reads the fields of the current mask. The first error stops
+// it, every read after that returns zero values.
+type binaryDecoder struct {
+	data          []byte
+	mask          uint64
+	err           error
+	schemaVersion int
+}
+
+func (d *binaryDecoder) message() ADSBMessage {
+	message := ADSBMessage{SchemaVersion: d.schemaVersion}
+
+	message.MessageType = d.string(fieldMessageType)
+	message.TransmissionType = int(d.int(fieldTransmissionType))
+	message.SessionId = d.string(fieldSessionId)
+	message.AircraftId = d.string(fieldAircraftId)
+	message.HexIdent = d.string(fieldHexIdent)
+	message.FlightId = d.string(fieldFlightId)
+	message.DateMessageGenerated = d.string(fieldDateMessageGenerated)
+	message.TimeMessageGenerated = d.string(fieldTimeMessageGenerated)
+	message.DateMessageLogged = d.string(fieldDateMessageLogged)
+	message.TimeMessageLogged = d.string(fieldTimeMessageLogged)
+	message.CallSign = d.string(fieldCallSign)
+	message.Altitude = d.float(fieldAltitude)
+	message.GroundSpeed = d.float(fieldGroundSpeed)
+	if d.has(fieldTrack) {
+		message.Track = Some(int(d.varint()))
+	}
+	message.Latitude = d.float(fieldLatitude)
+	message.Longitude = d.float(fieldLongitude)
+	message.VerticalRate = d.float(fieldVerticalRate)
+	message.Squawk = d.string(fieldSquawk)
+	message.Alert = d.flag(fieldAlert)
+	message.Emergency = d.flag(fieldEmergency)
+	message.Spi = d.flag(fieldSpi)
+	message.IsOnGround = d.flag(fieldIsOnGround)
+	message.Status = d.string(fieldStatus)
+	message.EventTime = d.time(fieldEventTime)
+	message.IngestTime = d.time(fieldIngestTime)
+	message.RawFrame = d.string(fieldRawFrame)
+	if d.has(fieldFrameTimestamp) {
+		message.FrameTimestamp = d.uvarint()
+	}
+	message.SignalLevel = d.float(fieldSignalLevel)
+	message.EmitterCategory = d.string(fieldEmitterCategory)
+	message.GeometricAltitude = d.float(fieldGeometricAltitude)
+	message.NIC = int(d.int(fieldNIC))
+	message.NACp = int(d.int(fieldNACp))
+	message.ReceiverId = d.string(fieldReceiverId)
+	message.ReceiverCount = int(d.int(fieldReceiverCount))
+	if d.has(fieldReceivers) {
+		count := d.uvarint()
+		if count > uint64(len(d.data)) {
+			d.err = InvalidBinaryMessage
+			return message
+		}
+
+		message.Receivers = make([]string, 0, count)
+		for i := uint64(0); i < count; i++ {
+			message.Receivers = append(message.Receivers, d.bytes())
+		}
+	}
+
+	return message
+}
+
+func (d *binaryDecoder) has(field int) bool {
+	return d.err == nil && d.mask&(1<<field) != 0
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	value, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = InvalidBinaryMessage
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return value
+}
+
+func (d *binaryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	value, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = InvalidBinaryMessage
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return value
+}
+
+func (d *binaryDecoder) bytes() string {
+	length := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if length > uint64(len(d.data)) {
+		d.err = InvalidBinaryMessage
+		return ""
+	}
+
+	value := string(d.data[:length])
+	d.data = d.data[length:]
+
+	return value
+}
+
+func (d *binaryDecoder) string(field int) string {
+	if !d.has(field) {
+		return ""
+	}
+
+	return d.bytes()
+}
+
+func (d *binaryDecoder) int(field int) int64 {
+	if !d.has(field) {
+		return 0
+	}
+
+	return d.varint()
+}
+
+func (d *binaryDecoder) float(field int) Optional[float64] {
+	if !d.has(field) {
+		return Optional[float64]{}
+	}
+	if len(d.data) < 8 {
+		d.err = InvalidBinaryMessage
+		return Optional[float64]{}
+	}
+
+	value := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+	d.data = d.data[8:]
+
+	return Some(value)
+}
+
+func (d *binaryDecoder) flag(field int) Optional[bool] {
+	if !d.has(field) {
+		return Optional[bool]{}
+	}
+	if len(d.data) < 1 || d.data[0] > 1 {
+		d.err = InvalidBinaryMessage
+		return Optional[bool]{}
+	}
+
+	value := d.data[0] == 1
+	d.data = d.data[1:]
+
+	return Some(value)
+}
+
+func (d *binaryDecoder) time(field int) time.Time {
+	if !d.has(field) {
+		return time.Time{}
+	}
+
+	return time.Unix(0, d.varint()).UTC()
+}
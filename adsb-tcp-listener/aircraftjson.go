@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+// aircraftJSON is the aircraft.json document served by dump1090 and readsb.
+// Older dump1090 versions use altitude/speed/vert_rate instead of
+// alt_baro/gs/baro_rate.
+type aircraftJSON struct {
+	Now      float64 `json:"now"`
+	Aircraft []struct {
+		Hex          string   `json:"hex"`
+		Flight       string   `json:"flight"`
+		AltBaro      any      `json:"alt_baro"`
+		Altitude     any      `json:"altitude"`
+		AltGeom      *float64 `json:"alt_geom"`
+		GroundSpeed  *float64 `json:"gs"`
+		Speed        *float64 `json:"speed"`
+		Track        *float64 `json:"track"`
+		BaroRate     *float64 `json:"baro_rate"`
+		VerticalRate *float64 `json:"vert_rate"`
+		Squawk       string   `json:"squawk"`
+		Emergency    string   `json:"emergency"`
+		Category     string   `json:"category"`
+		Latitude     *float64 `json:"lat"`
+		Longitude    *float64 `json:"lon"`
+		NIC          int      `json:"nic"`
+		NACp         int      `json:"nac_p"`
+		Seen         float64  `json:"seen"`
+		RSSI         *float64 `json:"rssi"`
+	} `json:"aircraft"`
+}
+
+// aircraftSnapshot is what we remember of an aircraft between two polls, to
+// only send what changed.
+// Values the feed never reported stay absent, rather than sent as zero.
+type aircraftSnapshot struct {
+	CallSign     string
+	Altitude     schema.Optional[float64]
+	IsOnGround   schema.Optional[bool]
+	Latitude     schema.Optional[float64]
+	Longitude    schema.Optional[float64]
+	GroundSpeed  schema.Optional[float64]
+	Track        schema.Optional[int]
+	VerticalRate schema.Optional[float64]
+}
+
+// AircraftJSONPoller polls the aircraft.json endpoint of a dump1090 or readsb
+// receiver, for sites where only the HTTP interface is reachable.
+type AircraftJSONPoller struct {
+	URL             string
+	Interval        time.Duration
+	MessagesChannel chan schema.ADSBMessage
+	httpClient      *http.Client
+	closeChannel    chan struct{}
+	previous        map[string]aircraftSnapshot
+}
+
+func NewAircraftJSONPoller(url string, interval time.Duration) *AircraftJSONPoller {
+	return &AircraftJSONPoller{
+		URL:             url,
+		Interval:        interval,
+		MessagesChannel: make(chan schema.ADSBMessage, 2000),
+		httpClient:      &http.Client{Timeout: interval + 5*time.Second},
+		closeChannel:    make(chan struct{}, 1),
+		previous:        make(map[string]aircraftSnapshot),
+	}
+}
+
+func (poller *AircraftJSONPoller) Messages() chan schema.ADSBMessage {
+	return poller.MessagesChannel
+}
+
+// Connect fetches the document once, so a wrong URL is reported at startup.
+func (poller *AircraftJSONPoller) Connect() error {
+	_, err := poller.fetch()
+	if err != nil {
+		log.Println("failed to fetch aircraft.json", err)
+		return err
+	}
+
+	return nil
+}
+
+func (poller *AircraftJSONPoller) Close() error {
+	poller.closeChannel <- struct{}{}
+	return nil
+}
+
+// StartListening polls until closed. The snapshot is diffed in one pass, the
+// workers count is only there to satisfy Source.
+func (poller *AircraftJSONPoller) StartListening(_ int) {
+	ticker := time.NewTicker(poller.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-poller.closeChannel:
+			return
+		case <-ticker.C:
+		}
+
+		document, err := poller.fetch()
+		if err != nil {
+			log.Println("failed to fetch aircraft.json", err)
+			continue
+		}
+
+		for _, message := range poller.diff(document) {
+			poller.MessagesChannel <- message
+		}
+	}
+}
+
+func (poller *AircraftJSONPoller) fetch() (aircraftJSON, error) {
+	response, err := poller.httpClient.Get(poller.URL)
+	if err != nil {
+		return aircraftJSON{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return aircraftJSON{}, fmt.Errorf("unexpected status %v", response.Status)
+	}
+
+	var document aircraftJSON
+	err = json.NewDecoder(response.Body).Decode(&document)
+	if err != nil {
+		return aircraftJSON{}, err
+	}
+
+	return document, nil
+}
+
+// diff compares the snapshot with the previous one and returns a message per
+// aircraft and per kind of change, using the SBS1 transmission types.
+func (poller *AircraftJSONPoller) diff(document aircraftJSON) []schema.ADSBMessage {
+	var messages []schema.ADSBMessage
+	current := make(map[string]aircraftSnapshot, len(document.Aircraft))
+	now := time.Now().UTC()
+
+	for _, aircraft := range document.Aircraft {
+		hexIdent := strings.ToUpper(aircraft.Hex)
+		previous, known := poller.previous[hexIdent]
+		snapshot := previous
+
+		generated := now
+		if document.Now > 0 {
+			seconds := document.Now - aircraft.Seen
+			generated = time.Unix(int64(seconds), int64(math.Mod(seconds, 1)*1e9)).UTC()
+		}
+
+		base := schema.ADSBMessage{
+			MessageType:          schema.MessageTypeTransmission,
+			HexIdent:             hexIdent,
+			DateMessageGenerated: generated.Format(schema.SBS1DateLayout),
+			TimeMessageGenerated: generated.Format(schema.SBS1TimeLayout),
+			DateMessageLogged:    now.Format(schema.SBS1DateLayout),
+			TimeMessageLogged:    now.Format(schema.SBS1TimeLayout),
+			EventTime:            generated,
+			IngestTime:           now,
+			Squawk:               aircraft.Squawk,
+			EmitterCategory:      aircraft.Category,
+			NIC:                  aircraft.NIC,
+			NACp:                 aircraft.NACp,
+		}
+		// older readsb versions do not report the emergency at all
+		if aircraft.Emergency != "" {
+			base.Emergency = schema.Some(aircraft.Emergency != "none")
+		}
+		if aircraft.RSSI != nil {
+			base.SignalLevel = schema.Some(*aircraft.RSSI)
+		}
+		if aircraft.AltGeom != nil {
+			base.GeometricAltitude = schema.Some(*aircraft.AltGeom)
+		}
+
+		altitude := aircraft.AltBaro
+		if altitude == nil {
+			altitude = aircraft.Altitude
+		}
+		switch altitude := altitude.(type) {
+		case float64:
+			snapshot.Altitude = schema.Some(altitude)
+			snapshot.IsOnGround = schema.Some(false)
+		case string:
+			if altitude == "ground" {
+				snapshot.Altitude = schema.Some(0.0)
+				snapshot.IsOnGround = schema.Some(true)
+			}
+		}
+
+		if callSign := strings.TrimSpace(aircraft.Flight); callSign != "" {
+			snapshot.CallSign = callSign
+		}
+		if aircraft.Latitude != nil && aircraft.Longitude != nil {
+			snapshot.Latitude = schema.Some(*aircraft.Latitude)
+			snapshot.Longitude = schema.Some(*aircraft.Longitude)
+		}
+		if speed := firstOf(aircraft.GroundSpeed, aircraft.Speed); speed != nil {
+			snapshot.GroundSpeed = schema.Some(*speed)
+		}
+		if aircraft.Track != nil {
+			snapshot.Track = schema.Some(int(math.Round(*aircraft.Track)) % 360)
+		}
+		if rate := firstOf(aircraft.BaroRate, aircraft.VerticalRate); rate != nil {
+			snapshot.VerticalRate = schema.Some(*rate)
+		}
+
+		current[hexIdent] = snapshot
+
+		if snapshot.CallSign != "" && (!known || snapshot.CallSign != previous.CallSign) {
+			message := base
+			message.TransmissionType = schema.TransmissionTypeIdentityAndCategory
+			message.CallSign = snapshot.CallSign
+			messages = append(messages, message)
+		}
+
+		positionChanged := snapshot.Latitude != previous.Latitude || snapshot.Longitude != previous.Longitude
+		if aircraft.Latitude != nil && (!known || positionChanged) {
+			message := base
+			message.TransmissionType = schema.TranmissionTypeAirbornePosition
+			if snapshot.IsOnGround.Value {
+				message.TransmissionType = schema.TranmissionTypeSurfacePosition
+			}
+			message.Altitude = snapshot.Altitude
+			message.Latitude = snapshot.Latitude
+			message.Longitude = snapshot.Longitude
+			message.IsOnGround = snapshot.IsOnGround
+			messages = append(messages, message)
+		} else if altitude != nil && (!known || snapshot.Altitude != previous.Altitude || snapshot.IsOnGround != previous.IsOnGround) {
+			message := base
+			message.TransmissionType = schema.TranmissionTypeSurveillanceAltitude
+			message.Altitude = snapshot.Altitude
+			message.IsOnGround = snapshot.IsOnGround
+			messages = append(messages, message)
+		}
+
+		velocityChanged := snapshot.GroundSpeed != previous.GroundSpeed || snapshot.Track != previous.Track || snapshot.VerticalRate != previous.VerticalRate
+		if (aircraft.GroundSpeed != nil || aircraft.Speed != nil) && (!known || velocityChanged) {
+			message := base
+			message.TransmissionType = schema.TranmissionTypeAirborneVelocity
+			message.GroundSpeed = snapshot.GroundSpeed
+			message.Track = snapshot.Track
+			message.VerticalRate = snapshot.VerticalRate
+			messages = append(messages, message)
+		}
+	}
+
+	poller.previous = current
+
+	return messages
+}
+
+func firstOf(values ...*float64) *float64 {
+	for _, value := range values {
+		if value != nil {
+			return value
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+// serveSnapshots serves the recorded aircraft.json files, one per request.
+func serveSnapshots(t *testing.T, files ...string) *httptest.Server {
+	t.Helper()
+
+	var snapshots [][]byte
+	for _, file := range files {
+		snapshot, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		snapshot := snapshots[min(requests, len(snapshots)-1)]
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(snapshot)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+type change struct {
+	hexIdent         string
+	transmissionType int
+}
+
+func changes(messages []schema.ADSBMessage) []change {
+	var result []change
+	for _, message := range messages {
+		result = append(result, change{message.HexIdent, message.TransmissionType})
+	}
+
+	return result
+}
+
+func TestAircraftJSONPollerSendsOnlyChanges(t *testing.T) {
+	server := serveSnapshots(t, "testdata/aircraft-1.json", "testdata/aircraft-2.json", "testdata/aircraft-3.json")
+	poller := NewAircraftJSONPoller(server.URL, time.Second)
+
+	polls := []struct {
+		name string
+		want []change
+	}{
+		{
+			name: "first snapshot sends everything known",
+			want: []change{
+				{"4CA2D6", schema.TransmissionTypeIdentityAndCategory},
+				{"4CA2D6", schema.TranmissionTypeAirbornePosition},
+				{"4CA2D6", schema.TranmissionTypeAirborneVelocity},
+				{"3C6444", schema.TranmissionTypeSurveillanceAltitude},
+			},
+		},
+		{
+			name: "only the position of 4CA2D6 moved",
+			want: []change{
+				{"4CA2D6", schema.TranmissionTypeAirbornePosition},
+			},
+		},
+		{
+			name: "only the call sign of 3C6444 appeared",
+			want: []change{
+				{"3C6444", schema.TransmissionTypeIdentityAndCategory},
+			},
+		},
+	}
+
+	for _, poll := range polls {
+		document, err := poller.fetch()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := changes(poller.diff(document))
+		if len(got) != len(poll.want) {
+			t.Fatalf("%v: got %v, want %v", poll.name, got, poll.want)
+		}
+		for i := range got {
+			if got[i] != poll.want[i] {
+				t.Fatalf("%v: got %v, want %v", poll.name, got, poll.want)
+			}
+		}
+	}
+}
+
+func TestAircraftJSONPollerMessages(t *testing.T) {
+	server := serveSnapshots(t, "testdata/aircraft-1.json")
+	poller := NewAircraftJSONPoller(server.URL, time.Second)
+
+	document, err := poller.fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := poller.diff(document)
+
+	identity := messages[0]
+	if identity.CallSign != "KLM1023" {
+		t.Errorf("call sign %q, want KLM1023", identity.CallSign)
+	}
+	wantTime := time.Unix(1709290799, 700000000).UTC()
+	if identity.EventTime.Sub(wantTime).Abs() > time.Millisecond {
+		t.Errorf("event time %v, want %v", identity.EventTime, wantTime)
+	}
+
+	position := messages[1]
+	if position.Latitude != schema.Some(52.308601) || position.Longitude != schema.Some(4.763889) {
+		t.Errorf("position %v %v", position.Latitude, position.Longitude)
+	}
+	if position.Altitude != schema.Some(35000.0) || position.IsOnGround != schema.Some(false) {
+		t.Errorf("altitude %v on ground %v", position.Altitude, position.IsOnGround)
+	}
+	if position.Emergency != schema.Some(false) {
+		t.Errorf("emergency %v, want false", position.Emergency)
+	}
+
+	ground := messages[3]
+	if ground.IsOnGround != schema.Some(true) {
+		t.Errorf("3C6444 on ground %v, want true", ground.IsOnGround)
+	}
+	if ground.Latitude.Valid || ground.GroundSpeed.Valid {
+		t.Errorf("3C6444 reported no position nor speed, got %v %v", ground.Latitude, ground.GroundSpeed)
+	}
+}
+
+func TestAircraftJSONPollerKeepsUnreportedFieldsAbsent(t *testing.T) {
+	server := serveSnapshots(t, "testdata/aircraft-partial.json")
+	poller := NewAircraftJSONPoller(server.URL, time.Second)
+
+	document, err := poller.fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := poller.diff(document)
+	if len(messages) != 2 {
+		t.Fatalf("got %v, want a position and a velocity", changes(messages))
+	}
+
+	position, velocity := messages[0], messages[1]
+	if !position.Latitude.Valid || position.Altitude.Valid || position.IsOnGround.Valid {
+		t.Errorf("position: latitude %v, altitude %v, on ground %v", position.Latitude, position.Altitude, position.IsOnGround)
+	}
+	if velocity.GroundSpeed != schema.Some(121.5) || velocity.Track.Valid || velocity.VerticalRate.Valid {
+		t.Errorf("velocity: speed %v, track %v, vertical rate %v", velocity.GroundSpeed, velocity.Track, velocity.VerticalRate)
+	}
+	if position.GeometricAltitude.Valid || position.SignalLevel != schema.Some(-28.0) {
+		t.Errorf("geometric altitude %v, signal level %v", position.GeometricAltitude, position.SignalLevel)
+	}
+	if position.Emergency.Valid || velocity.Emergency.Valid {
+		t.Errorf("emergency %v %v, want absent", position.Emergency, velocity.Emergency)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	InvalidAVRLine = errors.New("invalid AVR line")
+)
+
+// avrLine is a line read from an AVR feed, kept apart from SBS1 lines so the
+// parse stage knows how to read it.
+type avrLine string
+
+// parseAVRLine reads a frame in the AVR text format: "*<hex frame>;", or
+// "@<12 hex digits of timestamp><hex frame>;" when the receiver adds its
+// 12 MHz timestamp. AVR carries no signal level.
+func parseAVRLine(line string) (ModeSFrame, error) {
+	line = strings.TrimSpace(line)
+
+	if len(line) < 2 || !strings.HasSuffix(line, ";") {
+		return ModeSFrame{}, InvalidAVRLine
+	}
+
+	var timestamp uint64
+	body := line[1 : len(line)-1]
+
+	switch line[0] {
+	case '*':
+	case '@':
+		if len(body) < 12 {
+			return ModeSFrame{}, InvalidAVRLine
+		}
+
+		parsed, err := strconv.ParseUint(body[:12], 16, 64)
+		if err != nil {
+			return ModeSFrame{}, InvalidAVRLine
+		}
+
+		timestamp = parsed
+		body = body[12:]
+	default:
+		return ModeSFrame{}, InvalidAVRLine
+	}
+
+	var frameType byte
+	switch len(body) {
+	case 4:
+		frameType = BeastFrameModeAC
+	case 14:
+		frameType = BeastFrameModeSShort
+	case 28:
+		frameType = BeastFrameModeSLong
+	default:
+		return ModeSFrame{}, InvalidAVRLine
+	}
+
+	data, err := hex.DecodeString(body)
+	if err != nil {
+		return ModeSFrame{}, InvalidAVRLine
+	}
+
+	return ModeSFrame{
+		Type:      frameType,
+		Timestamp: timestamp,
+		Data:      data,
+	}, nil
+}
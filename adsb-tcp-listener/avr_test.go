@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseAVRLine(t *testing.T) {
+	tests := []struct {
+		line      string
+		frameType byte
+		timestamp uint64
+		data      string
+	}{
+		{"*8D4840D6202CC371C32CE0576098;", BeastFrameModeSLong, 0, "8D4840D6202CC371C32CE0576098"},
+		{"@0123456789AB8D4840D6202CC371C32CE0576098;\r\n", BeastFrameModeSLong, 0x0123456789AB, "8D4840D6202CC371C32CE0576098"},
+		{"*5D4840D6123456;", BeastFrameModeSShort, 0, "5D4840D6123456"},
+		{"@00000000001A5d4840d6123456;", BeastFrameModeSShort, 0x1A, "5D4840D6123456"},
+		{"*7700;", BeastFrameModeAC, 0, "7700"},
+	}
+
+	for _, test := range tests {
+		frame, err := parseAVRLine(test.line)
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+
+		data, _ := hex.DecodeString(test.data)
+		if frame.Type != test.frameType || frame.Timestamp != test.timestamp || !bytes.Equal(frame.Data, data) {
+			t.Errorf("%q: got type %q timestamp %X data %X", test.line, frame.Type, frame.Timestamp, frame.Data)
+		}
+		if frame.Signal != 0 {
+			t.Errorf("%q: signal %d, AVR carries none", test.line, frame.Signal)
+		}
+	}
+}
+
+func TestParseAVRLineRejects(t *testing.T) {
+	for _, line := range []string{
+		"",
+		";",
+		"*8D4840D6202CC371C32CE0576098",
+		"8D4840D6202CC371C32CE0576098;",
+		"*8D4840D6202CC371C32CE05760;",
+		"*8D4840D6202CC371C32CE057609800;",
+		"*8D4840D6202CC371C32CE05760ZZ;",
+		"*123;",
+		"@0123456789;",
+		"@0123456789XY8D4840D6202CC371C32CE0576098;",
+		"@0123456789AB8D4840D6202CC371C32CE05760;",
+	} {
+		_, err := parseAVRLine(line)
+		if !errors.Is(err, InvalidAVRLine) {
+			t.Errorf("%q: got %v, want InvalidAVRLine", line, err)
+		}
+	}
+}
+
+func TestAVRFeed(t *testing.T) {
+	client, feed := feedPipe(t, FormatAVR)
+	go client.StartListening(1)
+
+	go func() {
+		_, _ = feed.Write([]byte("*8D4840D6202CC371C32CE0576098;\r\nnot a frame\r\n@0123456789AB8D4840D6202CC371C32CE0576098;\r\n"))
+		_ = feed.Close()
+	}()
+
+	for _, timestamp := range []uint64{0, 0x0123456789AB} {
+		select {
+		case message := <-client.MessagesChannel:
+			if message.HexIdent != "4840D6" || message.CallSign != "KLM1023" || message.FrameTimestamp != timestamp {
+				t.Errorf("got %v %q at %X", message.HexIdent, message.CallSign, message.FrameTimestamp)
+			}
+			if message.RawFrame != "8D4840D6202CC371C32CE0576098" || message.SignalLevel.Valid {
+				t.Errorf("raw frame %v, signal %v", message.RawFrame, message.SignalLevel)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message from the AVR feed")
+		}
+	}
+
+	// broken lines are dropped like frames failing their CRC, not counted
+	if client.ParseFailures() != 0 {
+		t.Errorf("%d parse failures, want 0", client.ParseFailures())
+	}
+}
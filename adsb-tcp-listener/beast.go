@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"math"
+)
+
+const (
+	beastEscape = 0x1A
+
+	BeastFrameModeAC     = '1'
+	BeastFrameModeSShort = '2'
+	BeastFrameModeSLong  = '3'
+	BeastFrameStatus     = '4'
+)
+
+var (
+	InvalidBeastFrameType = errors.New("invalid beast frame type")
+	TruncatedBeastFrame   = errors.New("truncated beast frame")
+)
+
+// ModeSFrame is a single raw frame received from a receiver, along with the
+// 12 MHz receiver timestamp and the signal level the Beast feed attaches to it.
+type ModeSFrame struct {
+	Type      byte
+	Timestamp uint64
+	Signal    byte
+	Data      []byte
+}
+
+// RSSI returns the signal level in dBFS, the same scale readsb uses.
+func (frame ModeSFrame) RSSI() float64 {
+	if frame.Signal == 0 {
+		// below the weakest level the receiver can report, and JSON has no -Inf
+		return -50
+	}
+
+	level := float64(frame.Signal) / 255
+
+	return 10 * math.Log10(level*level)
+}
+
+type BeastReader struct {
+	reader       *bufio.Reader
+	atFrameStart bool
+}
+
+func NewBeastReader(reader *bufio.Reader) *BeastReader {
+	return &BeastReader{
+		reader: reader,
+	}
+}
+
+func beastPayloadLength(frameType byte) (int, error) {
+	switch frameType {
+	case BeastFrameModeAC:
+		return 2, nil
+	case BeastFrameModeSShort:
+		return 7, nil
+	case BeastFrameModeSLong:
+		return 14, nil
+	case BeastFrameStatus:
+		return 14, nil
+	default:
+		return 0, InvalidBeastFrameType
+	}
+}
+
+// ReadFrame returns the next frame from the stream. It resynchronises on the
+// next escape byte whenever it meets an unknown frame type, so a corrupted
+// frame costs us that frame only.
+func (r *BeastReader) ReadFrame() (ModeSFrame, error) {
+	for {
+		if !r.atFrameStart {
+			if err := r.syncToFrameStart(); err != nil {
+				return ModeSFrame{}, err
+			}
+		}
+		r.atFrameStart = false
+
+		frameType, err := r.reader.ReadByte()
+		if err != nil {
+			return ModeSFrame{}, err
+		}
+
+		payloadLength, err := beastPayloadLength(frameType)
+		if err != nil {
+			// an escaped 0x1A or garbage, look for the next frame
+			continue
+		}
+
+		// 6 bytes of timestamp, 1 byte of signal level, then the payload
+		buffer := make([]byte, 7+payloadLength)
+		err = r.readEscaped(buffer)
+		if errors.Is(err, TruncatedBeastFrame) {
+			r.atFrameStart = true
+			continue
+		}
+		if err != nil {
+			return ModeSFrame{}, err
+		}
+
+		var timestamp uint64
+		for _, b := range buffer[:6] {
+			timestamp = timestamp<<8 | uint64(b)
+		}
+
+		return ModeSFrame{
+			Type:      frameType,
+			Timestamp: timestamp,
+			Signal:    buffer[6],
+			Data:      buffer[7:],
+		}, nil
+	}
+}
+
+func (r *BeastReader) syncToFrameStart() error {
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if b == beastEscape {
+			return nil
+		}
+	}
+}
+
+// readEscaped fills buffer with frame bytes, collapsing every 0x1A 0x1A pair
+// back into a single 0x1A.
+func (r *BeastReader) readEscaped(buffer []byte) error {
+	for i := range buffer {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if b == beastEscape {
+			next, err := r.reader.ReadByte()
+			if err != nil {
+				return err
+			}
+
+			if next != beastEscape {
+				// start of a new frame inside this one, the frame is truncated
+				_ = r.reader.UnreadByte()
+				return TruncatedBeastFrame
+			}
+		}
+
+		buffer[i] = b
+	}
+
+	return nil
+}
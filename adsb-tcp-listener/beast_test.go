@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+// beastFrame encodes a frame the way a receiver sends it, doubling every 0x1A
+// after the frame start.
+func beastFrame(frameType byte, timestamp uint64, signal byte, data []byte) []byte {
+	var body []byte
+	for shift := 40; shift >= 0; shift -= 8 {
+		body = append(body, byte(timestamp>>shift))
+	}
+	body = append(body, signal)
+	body = append(body, data...)
+
+	frame := []byte{beastEscape, frameType}
+	for _, b := range body {
+		frame = append(frame, b)
+		if b == beastEscape {
+			frame = append(frame, beastEscape)
+		}
+	}
+
+	return frame
+}
+
+func readFrames(t *testing.T, stream []byte) []ModeSFrame {
+	t.Helper()
+
+	reader := NewBeastReader(bufio.NewReader(bytes.NewReader(stream)))
+	var frames []ModeSFrame
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestBeastReaderFrameTypes(t *testing.T) {
+	tests := []struct {
+		frameType byte
+		length    int
+	}{
+		{BeastFrameModeAC, 2},
+		{BeastFrameModeSShort, 7},
+		{BeastFrameModeSLong, 14},
+		{BeastFrameStatus, 14},
+	}
+
+	var stream []byte
+	for i, test := range tests {
+		data := bytes.Repeat([]byte{byte(i + 1)}, test.length)
+		stream = append(stream, beastFrame(test.frameType, 0, 0x80, data)...)
+	}
+
+	frames := readFrames(t, stream)
+	if len(frames) != len(tests) {
+		t.Fatalf("read %d frames, want %d", len(frames), len(tests))
+	}
+	for i, test := range tests {
+		if frames[i].Type != test.frameType || len(frames[i].Data) != test.length {
+			t.Errorf("frame %d: type %q with %d bytes, want %q with %d", i, frames[i].Type, len(frames[i].Data), test.frameType, test.length)
+		}
+		if !bytes.Equal(frames[i].Data, bytes.Repeat([]byte{byte(i + 1)}, test.length)) {
+			t.Errorf("frame %d: data %X", i, frames[i].Data)
+		}
+	}
+}
+
+func TestBeastReaderUnstuffsEscapes(t *testing.T) {
+	// 0x1A in the timestamp, the signal level and the payload
+	data := []byte{0x8D, 0x1A, 0x40, 0xD6, 0x1A, 0x1A, 0x2C}
+	stream := beastFrame(BeastFrameModeSShort, 0x1A0000001A1A, 0x1A, data)
+
+	frames := readFrames(t, stream)
+	if len(frames) != 1 {
+		t.Fatalf("read %d frames, want 1", len(frames))
+	}
+	frame := frames[0]
+	if frame.Timestamp != 0x1A0000001A1A || frame.Signal != 0x1A || !bytes.Equal(frame.Data, data) {
+		t.Fatalf("got timestamp %X signal %X data %X", frame.Timestamp, frame.Signal, frame.Data)
+	}
+}
+
+func TestBeastReaderResyncs(t *testing.T) {
+	long := bytes.Repeat([]byte{0x8D}, 14)
+	short := bytes.Repeat([]byte{0x5D}, 7)
+
+	var stream []byte
+	// garbage before the first frame
+	stream = append(stream, 0x00, 0xFF, 0x33, 0x31)
+	stream = append(stream, beastFrame(BeastFrameModeSLong, 1, 1, long)...)
+	// an unknown frame type
+	stream = append(stream, beastEscape, 'x', 0x01, 0x02)
+	stream = append(stream, beastFrame(BeastFrameModeSShort, 2, 2, short)...)
+	// a frame cut short by the start of the next one
+	stream = append(stream, beastFrame(BeastFrameModeSLong, 3, 3, long)[:10]...)
+	stream = append(stream, beastFrame(BeastFrameModeSShort, 4, 4, short)...)
+
+	frames := readFrames(t, stream)
+	if len(frames) != 3 {
+		t.Fatalf("read %d frames, want 3", len(frames))
+	}
+	for i, want := range []uint64{1, 2, 4} {
+		if frames[i].Timestamp != want {
+			t.Errorf("frame %d: timestamp %d, want %d", i, frames[i].Timestamp, want)
+		}
+	}
+}
+
+func TestBeastReaderTimestampAndSignal(t *testing.T) {
+	stream := beastFrame(BeastFrameModeSLong, 0x0123456789AB, 0xFF, make([]byte, 14))
+	stream = append(stream, beastFrame(BeastFrameModeSLong, 0, 0x80, make([]byte, 14))...)
+	stream = append(stream, beastFrame(BeastFrameModeSLong, 0, 0, make([]byte, 14))...)
+
+	frames := readFrames(t, stream)
+	if len(frames) != 3 {
+		t.Fatalf("read %d frames, want 3", len(frames))
+	}
+	if frames[0].Timestamp != 0x0123456789AB {
+		t.Errorf("timestamp %X", frames[0].Timestamp)
+	}
+
+	for i, want := range []float64{0, 20 * math.Log10(128.0/255), -50} {
+		if math.Abs(frames[i].RSSI()-want) > 1e-9 {
+			t.Errorf("frame %d: RSSI %v, want %v", i, frames[i].RSSI(), want)
+		}
+	}
+}
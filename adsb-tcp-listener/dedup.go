@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+var (
+	InvalidDedupWindow = errors.New("invalid dedup window")
+)
+
+// the window is checked at least this often, however short it is
+const minDedupTick = time.Millisecond
+
+type pendingMessage struct {
+	message   schema.ADSBMessage
+	receivers map[string]bool
+	expires   time.Time
+}
+
+// Deduplicator sits between the feeds and the producer. When several
+// receivers hear the same report it only lets the first copy through, once
+// the window is over, with the list of receivers that heard it.
+type Deduplicator struct {
+	window          time.Duration
+	input           chan schema.ADSBMessage
+	MessagesChannel chan schema.ADSBMessage
+	pending         map[reportKey]*pendingMessage
+	// keys in arrival order, the head is always the first to expire
+	queue []reportKey
+}
+
+func NewDeduplicator(input chan schema.ADSBMessage, window time.Duration) *Deduplicator {
+	return &Deduplicator{
+		window:          window,
+		input:           input,
+		MessagesChannel: make(chan schema.ADSBMessage, 2000),
+		pending:         make(map[reportKey]*pendingMessage),
+	}
+}
+
+// reportKey identifies a report regardless of the receiver that heard it. Raw
+// frames are compared byte for byte, SBS1 reports on what they carry.
+type reportKey struct {
+	rawFrame         string
+	hexIdent         string
+	messageType      string
+	transmissionType int
+	callSign         string
+	altitude         schema.Optional[float64]
+	groundSpeed      schema.Optional[float64]
+	track            schema.Optional[int]
+	latitude         schema.Optional[float64]
+	longitude        schema.Optional[float64]
+	verticalRate     schema.Optional[float64]
+	squawk           string
+	alert            schema.Optional[bool]
+	emergency        schema.Optional[bool]
+	spi              schema.Optional[bool]
+	isOnGround       schema.Optional[bool]
+	status           string
+}
+
+func newReportKey(message schema.ADSBMessage) reportKey {
+	if message.RawFrame != "" {
+		return reportKey{rawFrame: message.RawFrame}
+	}
+
+	return reportKey{
+		hexIdent:         message.HexIdent,
+		messageType:      message.MessageType,
+		transmissionType: message.TransmissionType,
+		callSign:         message.CallSign,
+		altitude:         message.Altitude,
+		groundSpeed:      message.GroundSpeed,
+		track:            message.Track,
+		latitude:         message.Latitude,
+		longitude:        message.Longitude,
+		verticalRate:     message.VerticalRate,
+		squawk:           message.Squawk,
+		alert:            message.Alert,
+		emergency:        message.Emergency,
+		spi:              message.Spi,
+		isOnGround:       message.IsOnGround,
+		status:           message.Status,
+	}
+}
+
+// checkDedupWindow parses the window, it must be positive.
+func checkDedupWindow(window string) (time.Duration, error) {
+	duration, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", InvalidDedupWindow, err)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%w: %v is not positive", InvalidDedupWindow, duration)
+	}
+
+	return duration, nil
+}
+
+func (d *Deduplicator) Start() {
+	ticker := time.NewTicker(max(d.window/4, minDedupTick))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message := <-d.input:
+			d.add(message, time.Now())
+		case now := <-ticker.C:
+			d.flush(now)
+		}
+	}
+}
+
+func (d *Deduplicator) add(message schema.ADSBMessage, now time.Time) {
+	key := newReportKey(message)
+
+	pending, found := d.pending[key]
+	if !found {
+		pending = &pendingMessage{
+			message:   message,
+			receivers: make(map[string]bool),
+			expires:   now.Add(d.window),
+		}
+		d.pending[key] = pending
+		d.queue = append(d.queue, key)
+	}
+
+	pending.receivers[message.ReceiverId] = true
+}
+
+func (d *Deduplicator) flush(now time.Time) {
+	for len(d.queue) > 0 {
+		key := d.queue[0]
+		pending := d.pending[key]
+		if pending.expires.After(now) {
+			return
+		}
+
+		d.queue = d.queue[1:]
+		delete(d.pending, key)
+
+		message := pending.message
+		message.ReceiverCount = len(pending.receivers)
+		message.Receivers = make([]string, 0, len(pending.receivers))
+		for receiverId := range pending.receivers {
+			if receiverId != "" {
+				message.Receivers = append(message.Receivers, receiverId)
+			}
+		}
+		sort.Strings(message.Receivers)
+
+		d.MessagesChannel <- message
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+func TestCheckDedupWindow(t *testing.T) {
+	for _, window := range []string{"0s", "-1s", "3ns", "soon"} {
+		duration, err := checkDedupWindow(window)
+		if window == "3ns" {
+			if err != nil || duration != 3 {
+				t.Errorf("%v: got %v %v", window, duration, err)
+			}
+			continue
+		}
+		if !errors.Is(err, InvalidDedupWindow) {
+			t.Errorf("%v: got %v %v, want InvalidDedupWindow", window, duration, err)
+		}
+	}
+}
+
+func TestDeduplicatorShortWindow(t *testing.T) {
+	input := make(chan schema.ADSBMessage)
+	deduplicator := NewDeduplicator(input, 3*time.Nanosecond)
+	go deduplicator.Start()
+
+	report := schema.ADSBMessage{MessageType: schema.MessageTypeTransmission, HexIdent: "4CA2D6", ReceiverId: "north"}
+	input <- report
+	report.ReceiverId = "south"
+	input <- report
+
+	select {
+	case message := <-deduplicator.MessagesChannel:
+		if message.HexIdent != "4CA2D6" {
+			t.Fatalf("got %v", message.HexIdent)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the report was never flushed")
+	}
+}
+
+func TestDeduplicatorMergesReceivers(t *testing.T) {
+	deduplicator := NewDeduplicator(nil, time.Second)
+	now := time.Now()
+
+	report := schema.ADSBMessage{MessageType: schema.MessageTypeTransmission, HexIdent: "4CA2D6", Altitude: schema.Some(35000.0)}
+	for _, receiverId := range []string{"south", "north", "south"} {
+		report.ReceiverId = receiverId
+		deduplicator.add(report, now)
+	}
+
+	deduplicator.flush(now.Add(500 * time.Millisecond))
+	if len(deduplicator.MessagesChannel) != 0 {
+		t.Fatal("flushed before the window was over")
+	}
+
+	deduplicator.flush(now.Add(time.Second))
+	message := <-deduplicator.MessagesChannel
+	if message.ReceiverCount != 2 || len(message.Receivers) != 2 || message.Receivers[0] != "north" {
+		t.Fatalf("got %v receivers %v", message.ReceiverCount, message.Receivers)
+	}
+}
+
+func TestReportKey(t *testing.T) {
+	report := schema.ADSBMessage{MessageType: schema.MessageTypeTransmission, HexIdent: "4CA2D6", Altitude: schema.Some(35000.0), ReceiverId: "north"}
+
+	other := report
+	other.ReceiverId = "south"
+	other.IngestTime = time.Now()
+	if newReportKey(report) != newReportKey(other) {
+		t.Error("the receiver or the ingest time tell two copies apart")
+	}
+
+	other.Altitude = schema.Some(35025.0)
+	if newReportKey(report) == newReportKey(other) {
+		t.Error("two altitudes share a key")
+	}
+
+	// an absent field is not a zero one
+	other.Altitude = schema.Some(0.0)
+	report.Altitude = schema.Optional[float64]{}
+	if newReportKey(report) == newReportKey(other) {
+		t.Error("an absent altitude shares a key with 0")
+	}
+
+	// raw frames carry everything decoded from them
+	report.RawFrame = "8D4840D6202CC371C32CE0576098"
+	other.RawFrame = report.RawFrame
+	if newReportKey(report) != newReportKey(other) {
+		t.Error("the same frame got two keys")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+var (
+	DuplicateReceiverId = errors.New("duplicate receiver id")
+)
+
+// FeedConfig describes one receiver feed. ReceiverId defaults to host:port, or
+// to the URL for aircraft-json feeds. A feed with Listen set accepts feeders
+// connecting to us on that address instead of dialing out.
+type FeedConfig struct {
+	ReceiverId     string   `json:"receiver_id"`
+	Listen         string   `json:"listen"`
+	MaxConnections int      `json:"max_connections"`
+	Host           string   `json:"host"`
+	Port           string   `json:"port"`
+	Format         string   `json:"format"`
+	URL            string   `json:"url"`
+	PollInterval   string   `json:"poll_interval"`
+	Latitude       *float64 `json:"lat"`
+	Longitude      *float64 `json:"lon"`
+	// Timezone of the SBS1 timestamps, an IANA name like Europe/Amsterdam,
+	// UTC by default
+	Timezone string `json:"timezone"`
+	// ReconnectMaxDelay caps the backoff between reconnections, a minute by
+	// default. ReconnectMaxRetries at 0 retries forever.
+	ReconnectMaxDelay   string `json:"reconnect_max_delay"`
+	ReconnectMaxRetries int    `json:"reconnect_max_retries"`
+}
+
+// ParseFeedConfigs reads the ADSB_FEEDS JSON array, e.g.
+// [{"receiver_id":"north","host":"10.0.0.2","port":"30005","format":"beast","lat":52.3,"lon":4.7}]
+func ParseFeedConfigs(feeds string) ([]FeedConfig, error) {
+	var configs []FeedConfig
+
+	err := json.Unmarshal([]byte(feeds), &configs)
+	if err != nil {
+		return nil, err
+	}
+
+	return configs, nil
+}
+
+// parseLocation reads a receiver location given as two strings, both empty
+// when the location is unknown.
+func parseLocation(latitude string, longitude string) (*float64, *float64, error) {
+	if latitude == "" || longitude == "" {
+		return nil, nil, nil
+	}
+
+	lat, err := strconv.ParseFloat(latitude, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lon, err := strconv.ParseFloat(longitude, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &lat, &lon, nil
+}
+
+func (config FeedConfig) id() string {
+	if config.ReceiverId != "" {
+		return config.ReceiverId
+	}
+
+	if config.Format == FormatAircraftJSON {
+		return config.URL
+	}
+
+	if config.Listen != "" {
+		return "listen@" + config.Listen
+	}
+
+	return config.Host + ":" + config.Port
+}
+
+func (config FeedConfig) newSource() (Source, error) {
+	if config.Format == FormatAircraftJSON {
+		interval := time.Second
+		if config.PollInterval != "" {
+			parsed, err := time.ParseDuration(config.PollInterval)
+			if err != nil {
+				return nil, err
+			}
+			interval = parsed
+		}
+
+		return NewAircraftJSONPoller(config.URL, interval), nil
+	}
+
+	timezone := time.UTC
+	if config.Timezone != "" {
+		var err error
+		timezone, err = time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Listen != "" {
+		server, err := NewInboundServer(config.Listen, config.Format, config.MaxConnections)
+		if err != nil {
+			return nil, err
+		}
+		server.Timezone = timezone
+
+		if config.Latitude != nil && config.Longitude != nil {
+			server.SetReceiverLocation(*config.Latitude, *config.Longitude)
+		}
+
+		return server, nil
+	}
+
+	client, err := NewADSBClient(config.Host, config.Port, config.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ReconnectMaxDelay != "" {
+		client.Reconnect.Max, err = time.ParseDuration(config.ReconnectMaxDelay)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client.Reconnect.MaxRetries = config.ReconnectMaxRetries
+	client.Timezone = timezone
+
+	if config.Latitude != nil && config.Longitude != nil {
+		client.SetReceiverLocation(*config.Latitude, *config.Longitude)
+	}
+
+	return client, nil
+}
+
+type feed struct {
+	receiverId string
+	source     Source
+}
+
+// Feeds runs one source per receiver and merges their messages into a single
+// channel, each message tagged with the receiver it came from. Sources with
+// several receivers behind them tag their messages first, the feed id is then
+// used as a prefix.
+type Feeds struct {
+	feeds           []feed
+	MessagesChannel chan schema.ADSBMessage
+}
+
+func NewFeeds(configs []FeedConfig) (*Feeds, error) {
+	feeds := &Feeds{
+		MessagesChannel: make(chan schema.ADSBMessage, 2000),
+	}
+	seen := make(map[string]bool, len(configs))
+
+	for _, config := range configs {
+		receiverId := config.id()
+		if seen[receiverId] {
+			return nil, fmt.Errorf("%w: %v", DuplicateReceiverId, receiverId)
+		}
+		seen[receiverId] = true
+
+		source, err := config.newSource()
+		if err != nil {
+			return nil, fmt.Errorf("feed %v: %w", receiverId, err)
+		}
+
+		feeds.feeds = append(feeds.feeds, feed{receiverId: receiverId, source: source})
+	}
+
+	return feeds, nil
+}
+
+// SetDeadLetters sends the records the feeds cannot parse to deadLetters, for
+// the feeds that support it.
+func (feeds *Feeds) SetDeadLetters(deadLetters chan<- DeadLetter) {
+	for _, feed := range feeds.feeds {
+		if source, ok := feed.source.(DeadLettering); ok {
+			source.SetDeadLetters(deadLetters)
+		}
+	}
+}
+
+func (feeds *Feeds) Messages() chan schema.ADSBMessage {
+	return feeds.MessagesChannel
+}
+
+// Connect connects every feed. A receiver that is down is not fatal, its
+// client keeps retrying once listening, but failing to listen for feeders is.
+func (feeds *Feeds) Connect() error {
+	for _, feed := range feeds.feeds {
+		err := feed.source.Connect()
+		if _, listening := feed.source.(*InboundServer); err != nil && listening {
+			return fmt.Errorf("feed %v: %w", feed.receiverId, err)
+		}
+		if err != nil {
+			log.Println("failed to connect to feed", feed.receiverId, "will keep retrying", err)
+			continue
+		}
+		log.Println("Connected to feed", feed.receiverId)
+	}
+
+	return nil
+}
+
+func (feeds *Feeds) StartListening(workers int) {
+	waitGroup := sync.WaitGroup{}
+
+	for _, feed := range feeds.feeds {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			feed.source.StartListening(workers)
+		}()
+
+		go func() {
+			for {
+				message := <-feed.source.Messages()
+				if message.ReceiverId != "" {
+					message.ReceiverId = feed.receiverId + "/" + message.ReceiverId
+				} else {
+					message.ReceiverId = feed.receiverId
+				}
+				feeds.MessagesChannel <- message
+			}
+		}()
+	}
+
+	waitGroup.Wait()
+}
+
+// Close closes every feed at once, each of them takes a few seconds to drain.
+func (feeds *Feeds) Close() error {
+	errs := make([]error, len(feeds.feeds))
+	waitGroup := sync.WaitGroup{}
+
+	for i, feed := range feeds.feeds {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			err := feed.source.Close()
+			if err != nil {
+				errs[i] = fmt.Errorf("feed %v: %w", feed.receiverId, err)
+			}
+		}()
+	}
+
+	waitGroup.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+// staticSource is a source sending its messages once listening.
+type staticSource struct {
+	messages chan schema.ADSBMessage
+	send     []schema.ADSBMessage
+	closed   chan struct{}
+}
+
+func newStaticSource(send ...schema.ADSBMessage) *staticSource {
+	return &staticSource{messages: make(chan schema.ADSBMessage, len(send)), send: send, closed: make(chan struct{})}
+}
+
+func (source *staticSource) Connect() error {
+	return nil
+}
+
+func (source *staticSource) StartListening(int) {
+	for _, message := range source.send {
+		source.messages <- message
+	}
+	<-source.closed
+}
+
+func (source *staticSource) Messages() chan schema.ADSBMessage {
+	return source.messages
+}
+
+func (source *staticSource) Close() error {
+	close(source.closed)
+	return nil
+}
+
+func TestParseFeedConfigs(t *testing.T) {
+	configs, err := ParseFeedConfigs(`[
+		{"receiver_id":"north","host":"10.0.0.2","port":"30005","format":"beast","lat":52.3,"lon":4.7},
+		{"host":"10.0.0.3","port":"30003"},
+		{"format":"aircraft-json","url":"http://10.0.0.4/data/aircraft.json","poll_interval":"2s"},
+		{"listen":":30004","format":"avr"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantIds := []string{"north", "10.0.0.3:30003", "http://10.0.0.4/data/aircraft.json", "listen@:30004"}
+	if len(configs) != len(wantIds) {
+		t.Fatalf("got %d feeds, want %d", len(configs), len(wantIds))
+	}
+	for i, want := range wantIds {
+		if configs[i].id() != want {
+			t.Errorf("feed %d: id %q, want %q", i, configs[i].id(), want)
+		}
+	}
+	if configs[0].Latitude == nil || *configs[0].Latitude != 52.3 || configs[1].Latitude != nil {
+		t.Errorf("locations %v %v", configs[0].Latitude, configs[1].Latitude)
+	}
+
+	_, err = ParseFeedConfigs(`{"host":"10.0.0.2"}`)
+	if err == nil {
+		t.Error("accepted a feed that is not in a list")
+	}
+}
+
+func TestNewFeeds(t *testing.T) {
+	feeds, err := NewFeeds([]FeedConfig{
+		{ReceiverId: "north", Host: "10.0.0.2", Port: "30005", Format: FormatBeast},
+		{Host: "10.0.0.3", Port: "30003"},
+		{Format: FormatAircraftJSON, URL: "http://10.0.0.4/data/aircraft.json"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds.feeds) != 3 {
+		t.Fatalf("got %d feeds", len(feeds.feeds))
+	}
+	if _, ok := feeds.feeds[2].source.(*AircraftJSONPoller); !ok {
+		t.Errorf("aircraft-json feed read by %T", feeds.feeds[2].source)
+	}
+
+	// two feeds from the same receiver could not be told apart
+	_, err = NewFeeds([]FeedConfig{{Host: "10.0.0.2", Port: "30005"}, {ReceiverId: "10.0.0.2:30005", Host: "10.0.0.9", Port: "30005"}})
+	if !errors.Is(err, DuplicateReceiverId) {
+		t.Errorf("got %v, want DuplicateReceiverId", err)
+	}
+
+	_, err = NewFeeds([]FeedConfig{{Host: "10.0.0.2", Port: "30005", Format: "json"}})
+	if !errors.Is(err, InvalidFeedFormat) {
+		t.Errorf("got %v, want InvalidFeedFormat", err)
+	}
+}
+
+func TestFeedsTagMessagesWithReceiver(t *testing.T) {
+	north := newStaticSource(schema.ADSBMessage{HexIdent: "4CA2D6"})
+	// a source with several feeders behind it tags its messages already
+	inbound := newStaticSource(schema.ADSBMessage{HexIdent: "3C6444", ReceiverId: "10.0.0.7:51234"})
+
+	feeds := &Feeds{
+		feeds:           []feed{{receiverId: "north", source: north}, {receiverId: "listen@:30004", source: inbound}},
+		MessagesChannel: make(chan schema.ADSBMessage, 2),
+	}
+	go feeds.StartListening(1)
+	defer feeds.Close()
+
+	want := map[string]string{"4CA2D6": "north", "3C6444": "listen@:30004/10.0.0.7:51234"}
+	for range want {
+		select {
+		case message := <-feeds.MessagesChannel:
+			if message.ReceiverId != want[message.HexIdent] {
+				t.Errorf("%v: receiver %q, want %q", message.HexIdent, message.ReceiverId, want[message.HexIdent])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message from the feeds")
+		}
+	}
+}
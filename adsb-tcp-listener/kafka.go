@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+var (
+	InvalidKafkaConfig = errors.New("invalid kafka configuration")
+)
+
+// KafkaSink produces every message as a Kafka record keyed by the hex ident,
+// so the messages of an aircraft land on the same partition, in order. The
+// client buffers up to BufferSize records while the brokers are unavailable,
+// the newest are dropped past that.
+type KafkaSink struct {
+	Brokers      []string
+	Topic        string
+	WireFormat   string
+	BufferSize   int
+	client       *kgo.Client
+	closeChannel chan struct{}
+	dropped      atomic.Uint64
+	lastDropLog  atomic.Int64
+}
+
+func NewKafkaSink(brokers []string, topic string) *KafkaSink {
+	return &KafkaSink{
+		Brokers:      brokers,
+		Topic:        topic,
+		WireFormat:   schema.WireFormatJSON,
+		BufferSize:   100000,
+		closeChannel: make(chan struct{}),
+	}
+}
+
+// Connect creates the client and checks a broker answers. The client keeps
+// retrying on its own, a broker not answering is not fatal. A client that
+// cannot be created is, as InvalidKafkaConfig.
+func (sink *KafkaSink) Connect() error {
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(sink.Brokers...),
+		kgo.DefaultProduceTopic(sink.Topic),
+		kgo.MaxBufferedRecords(sink.BufferSize),
+		kgo.ProducerLinger(5*time.Millisecond),
+	)
+	if err != nil {
+		return fmt.Errorf("%w: %v", InvalidKafkaConfig, err)
+	}
+	sink.client = client
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return client.Ping(ctx)
+}
+
+// Start waits for the sink to be closed, the client sends the records in the
+// background.
+func (sink *KafkaSink) Start() {
+	<-sink.closeChannel
+}
+
+func (sink *KafkaSink) SendMessage(message schema.ADSBMessage) {
+	// Connect failed for good
+	if sink.client == nil {
+		sink.produced(nil, InvalidKafkaConfig)
+		return
+	}
+
+	contentType, body, err := schema.Encode(sink.WireFormat, []schema.ADSBMessage{message})
+	if err != nil {
+		log.Println("failed to encode message, dropping it", err)
+		return
+	}
+
+	record := &kgo.Record{
+		Key:     []byte(message.HexIdent),
+		Value:   body,
+		Headers: []kgo.RecordHeader{{Key: "content-type", Value: []byte(contentType)}},
+	}
+
+	sink.client.TryProduce(context.Background(), record, sink.produced)
+}
+
+func (sink *KafkaSink) produced(_ *kgo.Record, err error) {
+	if err == nil {
+		return
+	}
+
+	dropped := sink.dropped.Add(1)
+	if rateLimited(&sink.lastDropLog, 10*time.Second) {
+		return
+	}
+
+	if errors.Is(err, kgo.ErrMaxBuffered) {
+		log.Println("kafka buffer full, dropped", dropped, "messages so far")
+	} else {
+		log.Println("failed to produce to kafka, dropped", dropped, "messages so far", err)
+	}
+}
+
+func (sink *KafkaSink) Dropped() uint64 {
+	return sink.dropped.Load()
+}
+
+// Close gives the buffered records a few seconds to be sent.
+func (sink *KafkaSink) Close() error {
+	close(sink.closeChannel)
+
+	if sink.client == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := sink.client.Flush(ctx)
+	sink.client.Close()
+
+	return err
+}
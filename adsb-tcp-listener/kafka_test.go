@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestKafkaSinkProducesKeyedRecords(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(3, "adsb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+
+	sink := NewKafkaSink(cluster.ListenAddrs(), "adsb")
+	sink.WireFormat = schema.WireFormatBinary
+	err = sink.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sink.Start()
+
+	sent := []schema.ADSBMessage{numbered(1), numbered(2), numbered(3)}
+	sent[1].HexIdent = "3C6444"
+	for _, message := range sent {
+		sink.SendMessage(message)
+	}
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics("adsb"),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// messages of an aircraft share a partition, in order
+	partitions := make(map[string]int32)
+	var received []schema.ADSBMessage
+	for len(received) < len(sent) {
+		fetches := consumer.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			t.Fatalf("received %d of %d records", len(received), len(sent))
+		}
+
+		fetches.EachRecord(func(record *kgo.Record) {
+			var contentType string
+			for _, header := range record.Headers {
+				if header.Key == "content-type" {
+					contentType = string(header.Value)
+				}
+			}
+			if contentType != schema.ContentTypeBinary {
+				t.Errorf("content type %q, want %q", contentType, schema.ContentTypeBinary)
+			}
+
+			messages, err := schema.Decode(contentType, record.Value)
+			if err != nil || len(messages) != 1 {
+				t.Fatalf("decoded %d messages, %v", len(messages), err)
+			}
+			if string(record.Key) != messages[0].HexIdent {
+				t.Errorf("key %q, want the hex ident %q", record.Key, messages[0].HexIdent)
+			}
+			if partition, ok := partitions[string(record.Key)]; ok && partition != record.Partition {
+				t.Errorf("%v produced to partitions %d and %d", record.Key, partition, record.Partition)
+			}
+			partitions[string(record.Key)] = record.Partition
+
+			received = append(received, messages[0])
+		})
+	}
+
+	var altitudes []float64
+	for _, message := range received {
+		if message.HexIdent == "4CA2D6" {
+			altitudes = append(altitudes, message.Altitude.Value)
+		}
+	}
+	if len(altitudes) != 2 || altitudes[0] != 1 || altitudes[1] != 3 {
+		t.Fatalf("4CA2D6 received as %v, want [1 3]", altitudes)
+	}
+}
+
+func TestKafkaSinkWithoutClient(t *testing.T) {
+	// a seed broker kgo refuses
+	sink := NewKafkaSink([]string{"kafka:port"}, "adsb")
+	err := sink.Connect()
+	if !errors.Is(err, InvalidKafkaConfig) {
+		t.Fatalf("got %v, want InvalidKafkaConfig", err)
+	}
+
+	sink.SendMessage(numbered(1))
+	if sink.Dropped() != 1 {
+		t.Fatalf("dropped %d messages, want 1", sink.Dropped())
+	}
+	if sink.Close() != nil {
+		t.Fatal("closing a sink with no client failed")
+	}
+}
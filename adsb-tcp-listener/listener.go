@@ -2,35 +2,123 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-schema/broker"
+	"github.com/fabricekabongo/adsb-tcp-listener/modes"
+)
+
+const (
+	FormatSBS1  = "sbs1"
+	FormatBeast = "beast"
+	FormatAVR   = "avr"
+	// FormatAircraftJSON is polled over HTTP by AircraftJSONPoller, not read by
+	// ADSBClient.
+	FormatAircraftJSON = "aircraft-json"
+)
+
+var (
+	InvalidFeedFormat = errors.New("invalid feed format")
+	UnusableFrame     = errors.New("unusable frame")
 )
 
 type ADSBClient struct {
 	Address         string
 	Port            string
+	Format          string
 	Connection      net.Conn
-	MessagesChannel chan ADSBMessage
-	closeChannel    chan struct{}
+	MessagesChannel chan schema.ADSBMessage
+	Reconnect       broker.Backoff
+	// Timezone the SBS1 date and time fields are written in
+	Timezone     *time.Location
+	closeChannel chan struct{}
+	positions    *modes.PositionDecoder
+	// inbound clients read a connection a feeder opened to us, there is
+	// nothing to reconnect to when it drops
+	inbound bool
+	// reconnection attempts since we last read something, so a receiver
+	// accepting connections and dropping them straight away still backs off
+	attempts       int
+	received       atomic.Uint64
+	parseFailures  atomic.Uint64
+	lastFailureLog atomic.Int64
+	deadLetters    chan<- DeadLetter
 }
 
-func NewADSBClient(address string, port string) *ADSBClient {
+func checkFormat(format string) (string, error) {
+	if format == "" {
+		return FormatSBS1, nil
+	}
+
+	if format != FormatSBS1 && format != FormatBeast && format != FormatAVR {
+		return "", InvalidFeedFormat
+	}
+
+	return format, nil
+}
+
+func NewADSBClient(address string, port string, format string) (*ADSBClient, error) {
+	format, err := checkFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ADSBClient{
 		Address:         address,
 		Port:            port,
-		MessagesChannel: make(chan ADSBMessage, 2000),
+		Format:          format,
+		MessagesChannel: make(chan schema.ADSBMessage, 2000),
+		Reconnect:       broker.DefaultBackoff,
+		Timezone:        time.UTC,
 		closeChannel:    make(chan struct{}, 1),
-	}
+		positions:       modes.NewPositionDecoder(),
+	}, nil
+}
+
+// SetReceiverLocation lets raw positions be decoded from a single frame, for
+// aircraft in range of the receiver.
+func (client *ADSBClient) SetReceiverLocation(latitude float64, longitude float64) {
+	client.positions.SetReceiverLocation(latitude, longitude)
+}
+
+func (client *ADSBClient) Messages() chan schema.ADSBMessage {
+	return client.MessagesChannel
+}
+
+// SetDeadLetters sends the SBS1 lines that fail to parse to deadLetters. Raw
+// frames are not, receivers hear many broken ones.
+func (client *ADSBClient) SetDeadLetters(deadLetters chan<- DeadLetter) {
+	client.deadLetters = deadLetters
+}
+
+// Received is the number of records read from the feed so far.
+func (client *ADSBClient) Received() uint64 {
+	return client.received.Load()
+}
+
+// ParseFailures is the number of records that could not be parsed so far.
+func (client *ADSBClient) ParseFailures() uint64 {
+	return client.parseFailures.Load()
 }
 
 func (client *ADSBClient) Close() error {
 	client.closeChannel <- struct{}{}
 	time.Sleep(3 * time.Second)
+
+	if client.Connection == nil {
+		return nil
+	}
+
 	return client.Connection.Close()
 }
 
@@ -50,111 +138,363 @@ func (client *ADSBClient) Connect() error {
 	return nil
 }
 
-func (client *ADSBClient) StartListening(workers int) {
+// newRecordReader returns a function reading the next record from the
+// current connection: a line for SBS1 and AVR, a ModeSFrame for Beast.
+func (client *ADSBClient) newRecordReader() func() (any, error) {
 	reader := bufio.NewReader(client.Connection)
+
+	if client.Format == FormatBeast {
+		beastReader := NewBeastReader(reader)
+		return func() (any, error) {
+			return beastReader.ReadFrame()
+		}
+	}
+
+	if client.Format == FormatAVR {
+		return func() (any, error) {
+			line, err := reader.ReadString('\n')
+			return avrLine(line), err
+		}
+	}
+
+	return func() (any, error) {
+		return reader.ReadString('\n')
+	}
+}
+
+func (client *ADSBClient) parseRecord(record any) (schema.ADSBMessage, error) {
+	switch record := record.(type) {
+	case ModeSFrame:
+		return client.parseFrame(record)
+	case avrLine:
+		frame, err := parseAVRLine(string(record))
+		if err != nil {
+			return schema.ADSBMessage{}, fmt.Errorf("%w: %w", UnusableFrame, err)
+		}
+		return client.parseFrame(frame)
+	case string:
+		return client.parseMessage(record)
+	default:
+		return schema.ADSBMessage{}, fmt.Errorf("unsupported record %T", record)
+	}
+}
+
+// StartListening reads the feed until the client is closed, reconnecting with
+// backoff whenever the connection drops. Records are parsed by workers
+// goroutines, each aircraft always handled by the same one so its messages
+// come out in the order they were received. A record that fails to parse is
+// counted and dropped.
+func (client *ADSBClient) StartListening(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
 	waitGroup := sync.WaitGroup{}
-	workChannel := make(chan string, workers)
-	continueScheduling := true
-	failureCount := 0
+	shards := make([]chan any, workers)
+	for i := range shards {
+		shards[i] = make(chan any, 100)
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+
+			for record := range shards[i] {
+				client.handleRecord(record)
+			}
+		}()
+	}
+
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
 
 	go func() {
-		<-client.closeChannel
-		continueScheduling = false
+		select {
+		case <-client.closeChannel:
+			close(closed)
+		case <-done:
+		}
 	}()
 
-	for continueScheduling {
-		message, err := reader.ReadString('\n')
+	// the first connection may have failed at startup already
+	if client.Connection == nil && !client.reconnect(closed) {
+		return
+	}
+	readRecord := client.newRecordReader()
+
+	for {
+		message, err := readRecord()
 		if err != nil {
-			if failureCount > 10 {
-				panic(err)
+			if isClosed(closed) {
+				break
 			}
 
-			failureCount++
-			log.Println("failed to read message", err)
-			log.Println("Will wait 10 seconds before trying again")
-			time.Sleep(10 * time.Second)
-			log.Println("Trying to reconnect")
-			client.Connection.Close()
-			err := client.Connect()
-			if err != nil {
-				log.Println("failed to reconnect", err)
-				log.Println("Will wait 10 seconds before trying again")
-				time.Sleep(10 * time.Second)
-				continue
+			if client.inbound {
+				log.Println("feeder connection closed", client.Connection.RemoteAddr(), err)
+				break
 			}
 
 			log.Println("failed to read message", err)
+			if !client.reconnect(closed) {
+				break
+			}
+
+			readRecord = client.newRecordReader()
 			continue
 		}
 
-		failureCount = 0
-		workChannel <- message
-		waitGroup.Add(1)
+		client.attempts = 0
+		client.received.Add(1)
+		if frame, ok := message.(ModeSFrame); ok && frame.Type == BeastFrameStatus {
+			continue
+		}
 
-		go func(message string) {
-			defer waitGroup.Done()
-			defer func() { <-workChannel }()
+		shards[recordShard(message)%uint32(workers)] <- message
+	}
 
-			parsedMessage, err := client.parseMessage(message)
-			if err != nil {
-				panic(err)
+	for _, shard := range shards {
+		close(shard)
+	}
+	waitGroup.Wait()
+}
+
+func (client *ADSBClient) handleRecord(record any) {
+	message, err := client.parseRecord(record)
+	if errors.Is(err, UnusableFrame) {
+		return
+	}
+	if err != nil {
+		client.parseFailed(record, err)
+		client.deadLetter(record, err)
+		return
+	}
+
+	client.MessagesChannel <- message
+}
+
+// deadLetter hands an SBS1 line over without waiting, it is dropped when the
+// dead letters are not keeping up.
+func (client *ADSBClient) deadLetter(record any, err error) {
+	line, ok := record.(string)
+	if client.deadLetters == nil || !ok {
+		return
+	}
+
+	receiver := client.Address + ":" + client.Port
+	if client.inbound {
+		receiver = client.Connection.RemoteAddr().String()
+	}
+
+	select {
+	case client.deadLetters <- DeadLetter{Record: line, Receiver: receiver, Reason: err}:
+	default:
+	}
+}
+
+// recordShard hashes the aircraft address of a record without parsing it. The
+// hash only needs to be stable within a feed, records with no address all
+// land on the first shard.
+func recordShard(record any) uint32 {
+	switch record := record.(type) {
+	case string:
+		// SBS1: the hex ident is the fifth field
+		start := 0
+		for field := 0; field < 4; field++ {
+			next := strings.IndexByte(record[start:], ',')
+			if next < 0 {
+				return 0
 			}
+			start += next + 1
+		}
+
+		end := strings.IndexByte(record[start:], ',')
+		if end < 0 {
+			return 0
+		}
 
-			client.MessagesChannel <- parsedMessage
-		}(message)
+		return fnv32(record[start : start+end])
+	case avrLine:
+		// the address is in bytes 1 to 3 of the frame, after the timestamp
+		// for the "@" variant
+		offset := 1
+		if strings.HasPrefix(string(record), "@") {
+			offset = 13
+		}
+		if len(record) < offset+8 {
+			return 0
+		}
+
+		return fnv32(string(record[offset+2 : offset+8]))
+	case ModeSFrame:
+		if len(record.Data) < 4 {
+			return 0
+		}
+
+		return fnv32(string(record.Data[1:4]))
+	default:
+		return 0
 	}
+}
 
-	waitGroup.Wait()
+// fnv32 is the FNV-1a hash of s.
+func fnv32(s string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= 16777619
+	}
+
+	return hash
 }
 
-func (client *ADSBClient) parseMessage(message string) (ADSBMessage, error) {
-	var messageParts = strings.Split(message, ",")
+func isClosed(closed chan struct{}) bool {
+	select {
+	case <-closed:
+		return true
+	default:
+		return false
+	}
+}
 
-	if len(messageParts) != 22 {
-		return ADSBMessage{}, fmt.Errorf("invalid message format")
+// reconnect dials the feed again until it answers, the client is closed or
+// the retries run out. It reports whether we are connected.
+func (client *ADSBClient) reconnect(closed chan struct{}) bool {
+	if client.Connection != nil {
+		_ = client.Connection.Close()
 	}
 
-	transmissionType, err := strconv.Atoi(messageParts[1])
+	for {
+		client.attempts++
+		if client.Reconnect.GivesUp(client.attempts) {
+			log.Println("giving up on", client.Address+":"+client.Port, "after", client.attempts-1, "attempts")
+			return false
+		}
+
+		delay := client.Reconnect.Delay(client.attempts)
+		log.Println("Will wait", delay.Round(time.Millisecond), "before reconnecting to", client.Address+":"+client.Port)
+
+		select {
+		case <-closed:
+			return false
+		case <-time.After(delay):
+		}
+
+		if client.Connect() == nil {
+			log.Println("Reconnected to", client.Address+":"+client.Port)
+			return true
+		}
+	}
+}
+
+// parseFailed counts a record we could not parse. Logging is limited to one
+// line per second, a feed in the wrong format fails on every record.
+func (client *ADSBClient) parseFailed(record any, err error) {
+	failures := client.parseFailures.Add(1)
+
+	if rateLimited(&client.lastFailureLog, time.Second) {
+		return
+	}
+
+	log.Printf("failed to parse record %q: %v (%v failures so far)\n", fmt.Sprint(record), err, failures)
+}
+
+// parseFrame decodes a raw Mode-S frame into the same message the SBS1 feed
+// would have produced, keeping the raw bytes, the receiver timestamp and the
+// signal level. Frames failing the CRC or carrying nothing we can use are
+// reported as UnusableFrame.
+func (client *ADSBClient) parseFrame(frame ModeSFrame) (schema.ADSBMessage, error) {
+	if frame.Type == BeastFrameModeAC {
+		return schema.ADSBMessage{}, fmt.Errorf("%w: mode A/C reply", UnusableFrame)
+	}
+
+	decoded, err := modes.Decode(frame.Data)
 	if err != nil {
-		return ADSBMessage{}, err
-	}
-
-	altitude, _ := strconv.ParseFloat(messageParts[11], 64)
-	groundSpeed, _ := strconv.ParseFloat(messageParts[12], 64)
-	track, _ := strconv.Atoi(messageParts[13])
-	latitude, _ := strconv.ParseFloat(messageParts[14], 64)
-	longitude, _ := strconv.ParseFloat(messageParts[15], 64)
-	verticalRate, _ := strconv.ParseFloat(messageParts[16], 64)
-
-	alert, _ := strconv.ParseBool(messageParts[18])
-	emergency, _ := strconv.ParseBool(messageParts[19])
-	spi, _ := strconv.ParseBool(messageParts[20])
-	isOnGround, _ := strconv.ParseBool(messageParts[21])
-
-	var adsbMessage = ADSBMessage{
-		MessageType:          messageParts[0],
-		TransmissionType:     transmissionType,
-		SessionId:            messageParts[2],
-		AircraftId:           messageParts[3],
-		HexIdent:             messageParts[4],
-		FlightId:             messageParts[5],
-		DateMessageGenerated: messageParts[6],
-		TimeMessageGenerated: messageParts[7],
-		DateMessageLogged:    messageParts[8],
-		TimeMessageLogged:    messageParts[9],
-		CallSign:             messageParts[10],
-		Altitude:             altitude,
-		GroundSpeed:          groundSpeed,
-		Track:                track,
-		Latitude:             latitude,
-		Longitude:            longitude,
-		VerticalRate:         verticalRate,
-		Squawk:               messageParts[17],
-		Alert:                alert,
-		Emergency:            emergency,
-		Spi:                  spi,
-		IsOnGround:           isOnGround,
-	}
-
-	return adsbMessage, nil
+		return schema.ADSBMessage{}, fmt.Errorf("%w: %w", UnusableFrame, err)
+	}
+
+	hexIdent := fmt.Sprintf("%06X", decoded.Address)
+	if decoded.NonICAOAddress {
+		hexIdent = "~" + hexIdent
+	}
+
+	// the frame timestamp is a free running counter, the frame is dated when
+	// we read it
+	now := time.Now().UTC()
+
+	message := schema.ADSBMessage{
+		MessageType:     schema.MessageTypeTransmission,
+		HexIdent:        hexIdent,
+		EventTime:       now,
+		IngestTime:      now,
+		RawFrame:        strings.ToUpper(hex.EncodeToString(frame.Data)),
+		FrameTimestamp:  frame.Timestamp,
+		CallSign:        decoded.Callsign,
+		EmitterCategory: decoded.EmitterCategory,
+		NIC:             decoded.NIC,
+		NACp:            decoded.NACp,
+	}
+
+	// AVR feeds carry no signal level
+	if frame.Signal != 0 {
+		message.SignalLevel = schema.Some(frame.RSSI())
+	}
+
+	if decoded.HasAltitude {
+		message.Altitude = schema.Some(float64(decoded.Altitude))
+	}
+	if decoded.HasGeometricAltitude {
+		message.GeometricAltitude = schema.Some(float64(decoded.GeometricAltitude))
+	}
+	if decoded.HasVelocity {
+		message.GroundSpeed = schema.Some(decoded.GroundSpeed)
+	}
+	if decoded.HasTrack {
+		message.Track = schema.Some(int(math.Round(decoded.Track)) % 360)
+	}
+	if decoded.HasVerticalRate {
+		message.VerticalRate = schema.Some(float64(decoded.VerticalRate))
+	}
+
+	switch {
+	case decoded.DownlinkFormat == 11:
+		message.TransmissionType = schema.TranmissionTypeAllCallReply
+	case decoded.TypeCode >= 1 && decoded.TypeCode <= 4:
+		message.TransmissionType = schema.TransmissionTypeIdentityAndCategory
+	case decoded.TypeCode == 19:
+		message.TransmissionType = schema.TranmissionTypeAirborneVelocity
+	case decoded.Position != nil:
+		latitude, longitude, ok := client.positions.Decode(hexIdent, *decoded.Position, now)
+
+		switch {
+		case ok && decoded.Position.Surface:
+			message.TransmissionType = schema.TranmissionTypeSurfacePosition
+		case ok:
+			message.TransmissionType = schema.TranmissionTypeAirbornePosition
+		case !decoded.Position.Surface:
+			// no position until the matching frame arrives, the altitude is
+			// still worth forwarding
+			message.TransmissionType = schema.TranmissionTypeSurveillanceAltitude
+		default:
+			return schema.ADSBMessage{}, fmt.Errorf("%w: undecoded surface position", UnusableFrame)
+		}
+
+		if ok {
+			message.Latitude = schema.Some(latitude)
+			message.Longitude = schema.Some(longitude)
+		}
+
+		// the flags only come with positions, surface ones carry none but
+		// the ground state
+		message.IsOnGround = schema.Some(decoded.OnGround)
+		if !decoded.Position.Surface {
+			message.Alert = schema.Some(decoded.Alert)
+			message.Emergency = schema.Some(decoded.Emergency)
+			message.Spi = schema.Some(decoded.Spi)
+		}
+	default:
+		// operational status and the like, no SBS1 equivalent
+		message.MessageType = schema.MessageTypeRaw
+	}
+
+	return message, nil
 }
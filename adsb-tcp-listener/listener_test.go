@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-tcp-listener/modes"
+)
+
+// sbs1Line is an airborne position record, its altitude tells the order it
+// was sent in.
+func sbs1Line(hexIdent string, sequence int) string {
+	return fmt.Sprintf("MSG,3,1,1,%v,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,%d,,,52.3086,4.7639,,,0,0,0,0\r\n", hexIdent, sequence)
+}
+
+// feedPipe is a client reading the end of a pipe the test writes the feed to.
+// It reads it like a feeder connection, so it stops at the end of the feed
+// instead of reconnecting.
+func feedPipe(t *testing.T, format string) (*ADSBClient, net.Conn) {
+	t.Helper()
+
+	client, err := NewADSBClient("", "", format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed, connection := net.Pipe()
+	client.Connection = connection
+	client.inbound = true
+	t.Cleanup(func() { _ = feed.Close() })
+
+	return client, feed
+}
+
+func TestStartListeningKeepsAircraftOrder(t *testing.T) {
+	const aircraft = 203
+	const records = 50
+
+	client, feed := feedPipe(t, FormatSBS1)
+	listening := make(chan struct{})
+	go func() {
+		defer close(listening)
+		client.StartListening(8)
+	}()
+
+	// every aircraft in turn, so their records are interleaved as on a busy
+	// receiver, written in bursts that keep all the workers busy
+	go func() {
+		for sequence := 0; sequence < records; sequence++ {
+			var burst []byte
+			for i := 0; i < aircraft; i++ {
+				burst = append(burst, sbs1Line(fmt.Sprintf("%06X", 0x400000+i), sequence)...)
+			}
+
+			// fails once the test is over and the pipe closed
+			_, err := feed.Write(burst)
+			if err != nil {
+				return
+			}
+		}
+		_ = feed.Close()
+	}()
+
+	next := make(map[string]int, aircraft)
+	for received := 0; received < aircraft*records; received++ {
+		var message schema.ADSBMessage
+		select {
+		case message = <-client.MessagesChannel:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d messages", received, aircraft*records)
+		}
+
+		sequence := int(message.Altitude.Value)
+		if sequence != next[message.HexIdent] {
+			t.Fatalf("%v: got record %d, want %d", message.HexIdent, sequence, next[message.HexIdent])
+		}
+		next[message.HexIdent]++
+	}
+
+	select {
+	case <-listening:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartListening did not return at the end of the feed")
+	}
+
+	if client.Received() != aircraft*records || client.ParseFailures() != 0 {
+		t.Fatalf("received %d records, %d failures", client.Received(), client.ParseFailures())
+	}
+}
+
+func TestRecordShardFollowsAircraft(t *testing.T) {
+	for _, hexIdent := range []string{"4CA2D6", "3C6444", "~2A1B3C"} {
+		position := recordShard(sbs1Line(hexIdent, 1))
+		identity := recordShard("MSG,1,1,1," + hexIdent + ",1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,KLM1023,,,,,,,,,,,\r\n")
+		if position != identity || position != fnv32(hexIdent) {
+			t.Errorf("%v: records sharded apart, %d and %d", hexIdent, position, identity)
+		}
+	}
+
+	if recordShard("garbage") != 0 {
+		t.Error("a record with no hex ident must land on the first shard")
+	}
+}
+
+// surfaceFrame is a DF17 surface position of 4840D6 at 17 kt, with its heading
+// when heading is not negative.
+func surfaceFrame(heading int) []byte {
+	me := uint64(6)<<51 | uint64(41)<<44 | uint64(1)<<34 | uint64(39195)<<17 | uint64(110320)
+	if heading >= 0 {
+		me |= uint64(1)<<43 | uint64(heading)<<36
+	}
+
+	data := []byte{0x8D, 0x48, 0x40, 0xD6}
+	for shift := 48; shift >= 0; shift -= 8 {
+		data = append(data, byte(me>>shift))
+	}
+	data = append(data, 0, 0, 0)
+	crc := modes.Checksum(data)
+	data[11], data[12], data[13] = byte(crc>>16), byte(crc>>8), byte(crc)
+
+	return data
+}
+
+func TestParseFrameSurfaceHeading(t *testing.T) {
+	client, err := NewADSBClient("", "", FormatBeast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a receiver next to the aircraft, surface positions need a reference
+	latitude, longitude := modes.DecodeLocal(modes.EncodedPosition{Odd: true, Surface: true, Latitude: 39195, Longitude: 110320}, 52.3, 4.76)
+	client.SetReceiverLocation(latitude, longitude)
+
+	message, err := client.parseFrame(ModeSFrame{Type: BeastFrameModeSLong, Data: surfaceFrame(-1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.TransmissionType != schema.TranmissionTypeSurfacePosition || message.GroundSpeed != schema.Some(17.0) {
+		t.Fatalf("transmission type %d, speed %v", message.TransmissionType, message.GroundSpeed)
+	}
+	if message.Track.Valid {
+		t.Errorf("heading %v sent while the aircraft reported none", message.Track)
+	}
+
+	message, err = client.parseFrame(ModeSFrame{Type: BeastFrameModeSLong, Data: surfaceFrame(32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Track != schema.Some(90) {
+		t.Errorf("heading %v, want 90", message.Track)
+	}
+}
+
+func TestParseFailuresDoNotPanic(t *testing.T) {
+	client, err := NewADSBClient("", "", FormatSBS1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []any{
+		"",
+		"MSG",
+		"MSG,3,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,high,,,north,east,,,0,0,0,0",
+		"MSG,3,1,1,4CA2D6,1,yesterday,noon,2024/03/01,10:00:00.000,,35000,,,52.3086,4.7639,,,0,0,0,0",
+		"MSG,99,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,,,,,,,,,,,",
+		strings.Repeat(",", 10000),
+		avrLine(""),
+		avrLine("*8D4840D6;"),
+		avrLine("@zz*8D4840D6202CC371C32CE0576098;"),
+		ModeSFrame{},
+		ModeSFrame{Type: BeastFrameModeSLong, Data: []byte{0x8D}},
+		ModeSFrame{Type: BeastFrameModeSLong, Data: make([]byte, 14)},
+		42,
+		nil,
+	}
+	for _, record := range records {
+		client.handleRecord(record)
+	}
+
+	// every failure is counted even though only the first one is logged
+	if client.ParseFailures() == 0 {
+		t.Error("no parse failure counted")
+	}
+	if len(client.MessagesChannel) != 0 {
+		t.Errorf("%d messages out of garbage", len(client.MessagesChannel))
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNewSourceListenOnly(t *testing.T) {
+	defer func(listen, host, port string) { adsbListen, adsbHost, adsbPort = listen, host, port }(adsbListen, adsbHost, adsbPort)
+
+	// no single feed is added unless its host and port are set
+	adsbListen, adsbHost, adsbPort = "127.0.0.1:0", "", ""
+	if missingAdsbConfig() {
+		t.Fatal("listening is not enough")
+	}
+
+	source, err := newSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := source.(*Feeds)
+	if len(feeds.feeds) != 1 || feeds.feeds[0].receiverId != "listen@127.0.0.1:0" {
+		t.Fatalf("got feeds %+v", feeds.feeds)
+	}
+
+	adsbHost, adsbPort = "10.0.0.2", "30003"
+	source, err = newSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(source.(*Feeds).feeds) != 2 {
+		t.Fatalf("got feeds %+v", source.(*Feeds).feeds)
+	}
+}
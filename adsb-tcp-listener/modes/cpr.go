@@ -0,0 +1,318 @@
+package modes
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	cprScale = 1 << 17
+
+	// how far apart an even and an odd frame can be to be decoded together
+	airbornePairWindow = 10 * time.Second
+	surfacePairWindow  = 25 * time.Second
+
+	// how long a decoded position can serve as reference for a local decode
+	referenceValidity = 10 * time.Minute
+
+	// local decoding is only unambiguous within half a zone of the reference
+	airborneReceiverRange = 180.0 // nautical miles
+	surfaceReceiverRange  = 45.0  // nautical miles
+
+	earthRadius = 3440.065 // nautical miles
+)
+
+// NL returns the number of longitude zones at the given latitude.
+func NL(latitude float64) int {
+	latitude = math.Abs(latitude)
+
+	switch {
+	case latitude == 0:
+		return 59
+	case latitude == 87:
+		return 2
+	case latitude > 87:
+		return 1
+	}
+
+	a := 1 - math.Cos(math.Pi/(2*15))
+	b := math.Pow(math.Cos(math.Pi/180*latitude), 2)
+
+	return int(math.Floor(2 * math.Pi / math.Acos(1-a/b)))
+}
+
+func positiveModulo(x float64, y float64) float64 {
+	return x - y*math.Floor(x/y)
+}
+
+func cprSpan(surface bool) float64 {
+	if surface {
+		return 90
+	}
+
+	return 360
+}
+
+// DecodeGlobal decodes an even/odd pair of frames into a position. The most
+// recent frame decides which of the two positions is returned. Surface pairs
+// are ambiguous by a multiple of 90 degrees, they need a reference close to the
+// aircraft to pick the right solution. ok is false when both frames do not
+// fall in the same longitude zone.
+func DecodeGlobal(even EncodedPosition, odd EncodedPosition, latestOdd bool, referenceLatitude float64, referenceLongitude float64) (latitude float64, longitude float64, ok bool) {
+	span := cprSpan(even.Surface)
+	latEven := float64(even.Latitude) / cprScale
+	latOdd := float64(odd.Latitude) / cprScale
+	lonEven := float64(even.Longitude) / cprScale
+	lonOdd := float64(odd.Longitude) / cprScale
+
+	j := math.Floor(59*latEven - 60*latOdd + 0.5)
+	rlatEven := span / 60 * (positiveModulo(j, 60) + latEven)
+	rlatOdd := span / 59 * (positiveModulo(j, 59) + latOdd)
+
+	if even.Surface {
+		// pick the hemisphere of the reference
+		if referenceLatitude < 0 {
+			rlatEven -= 90
+			rlatOdd -= 90
+		}
+	} else {
+		if rlatEven >= 270 {
+			rlatEven -= 360
+		}
+		if rlatOdd >= 270 {
+			rlatOdd -= 360
+		}
+	}
+
+	if rlatEven < -90 || rlatEven > 90 || rlatOdd < -90 || rlatOdd > 90 {
+		return 0, 0, false
+	}
+
+	// the aircraft crossed a zone boundary between the two frames
+	if NL(rlatEven) != NL(rlatOdd) {
+		return 0, 0, false
+	}
+
+	latitude = rlatEven
+	if latestOdd {
+		latitude = rlatOdd
+	}
+
+	nl := float64(NL(latitude))
+	m := math.Floor(lonEven*(nl-1) - lonOdd*nl + 0.5)
+
+	var ni float64
+	if latestOdd {
+		ni = math.Max(nl-1, 1)
+		longitude = span / ni * (positiveModulo(m, ni) + lonOdd)
+	} else {
+		ni = math.Max(nl, 1)
+		longitude = span / ni * (positiveModulo(m, ni) + lonEven)
+	}
+
+	if even.Surface {
+		// one of the four quadrant solutions, take the closest to the reference
+		longitude += 90 * math.Round((referenceLongitude-longitude)/90)
+	}
+
+	longitude = positiveModulo(longitude+180, 360) - 180
+
+	return latitude, longitude, true
+}
+
+// DecodeLocal decodes a single frame relative to a reference position, which
+// must be within half a zone of the aircraft for the result to be right.
+func DecodeLocal(position EncodedPosition, referenceLatitude float64, referenceLongitude float64) (latitude float64, longitude float64) {
+	span := cprSpan(position.Surface)
+	lat := float64(position.Latitude) / cprScale
+	lon := float64(position.Longitude) / cprScale
+
+	zones := 60.0
+	if position.Odd {
+		zones = 59
+	}
+
+	dLat := span / zones
+	j := math.Floor(referenceLatitude/dLat) + math.Floor(0.5+positiveModulo(referenceLatitude, dLat)/dLat-lat)
+	latitude = dLat * (j + lat)
+
+	ni := float64(NL(latitude))
+	if position.Odd {
+		ni--
+	}
+	dLon := span / math.Max(ni, 1)
+	m := math.Floor(referenceLongitude/dLon) + math.Floor(0.5+positiveModulo(referenceLongitude, dLon)/dLon-lon)
+	longitude = positiveModulo(dLon*(m+lon)+180, 360) - 180
+
+	return latitude, longitude
+}
+
+// Distance is the great circle distance between two positions, in nautical
+// miles.
+func Distance(latitude1 float64, longitude1 float64, latitude2 float64, longitude2 float64) float64 {
+	lat1 := latitude1 * math.Pi / 180
+	lat2 := latitude2 * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (longitude2 - longitude1) * math.Pi / 180
+
+	a := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+type aircraftPosition struct {
+	even       EncodedPosition
+	evenAt     time.Time
+	odd        EncodedPosition
+	oddAt      time.Time
+	latitude   float64
+	longitude  float64
+	positionAt time.Time
+}
+
+// PositionDecoder keeps the recent even/odd frames of every aircraft and turns
+// each new frame into a position, globally when the matching frame is recent
+// enough, locally against the last known position or the receiver otherwise.
+type PositionDecoder struct {
+	mutex       sync.Mutex
+	aircraft    map[string]*aircraftPosition
+	hasReceiver bool
+	receiverLat float64
+	receiverLon float64
+	lastPrune   time.Time
+}
+
+func NewPositionDecoder() *PositionDecoder {
+	return &PositionDecoder{
+		aircraft:  make(map[string]*aircraftPosition),
+		lastPrune: time.Now(),
+	}
+}
+
+// SetReceiverLocation gives the decoder a reference for aircraft it has no
+// position for yet.
+func (d *PositionDecoder) SetReceiverLocation(latitude float64, longitude float64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.hasReceiver = true
+	d.receiverLat = latitude
+	d.receiverLon = longitude
+}
+
+// Decode records the frame for the aircraft and returns its position if one
+// can be decoded.
+func (d *PositionDecoder) Decode(hexIdent string, position EncodedPosition, at time.Time) (latitude float64, longitude float64, ok bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.prune(at)
+
+	state, found := d.aircraft[hexIdent]
+	if !found {
+		state = &aircraftPosition{}
+		d.aircraft[hexIdent] = state
+	}
+
+	if position.Odd {
+		state.odd = position
+		state.oddAt = at
+	} else {
+		state.even = position
+		state.evenAt = at
+	}
+
+	referenceLat, referenceLon, hasReference := d.reference(state, at)
+
+	latitude, longitude, ok = d.decodeGlobal(state, position, at, referenceLat, referenceLon, hasReference)
+	if !ok && hasReference {
+		latitude, longitude = DecodeLocal(position, referenceLat, referenceLon)
+		ok = d.withinRange(state, position.Surface, at, latitude, longitude)
+	}
+
+	if !ok {
+		return 0, 0, false
+	}
+
+	state.latitude = latitude
+	state.longitude = longitude
+	state.positionAt = at
+
+	return latitude, longitude, true
+}
+
+func (d *PositionDecoder) decodeGlobal(state *aircraftPosition, position EncodedPosition, at time.Time, referenceLat float64, referenceLon float64, hasReference bool) (float64, float64, bool) {
+	window := airbornePairWindow
+	if position.Surface {
+		window = surfacePairWindow
+
+		// surface decoding is ambiguous without a reference
+		if !hasReference {
+			return 0, 0, false
+		}
+	}
+
+	if state.evenAt.IsZero() || state.oddAt.IsZero() || state.even.Surface != state.odd.Surface {
+		return 0, 0, false
+	}
+
+	gap := state.evenAt.Sub(state.oddAt)
+	if gap < 0 {
+		gap = -gap
+	}
+	if gap > window || at.Sub(state.evenAt) > window || at.Sub(state.oddAt) > window {
+		return 0, 0, false
+	}
+
+	return DecodeGlobal(state.even, state.odd, position.Odd, referenceLat, referenceLon)
+}
+
+// reference returns the last decoded position of the aircraft when it is
+// recent enough, the receiver location otherwise.
+func (d *PositionDecoder) reference(state *aircraftPosition, at time.Time) (float64, float64, bool) {
+	if !state.positionAt.IsZero() && at.Sub(state.positionAt) < referenceValidity {
+		return state.latitude, state.longitude, true
+	}
+
+	return d.receiverLat, d.receiverLon, d.hasReceiver
+}
+
+// withinRange checks a locally decoded position against the receiver range
+// when the receiver was the reference.
+func (d *PositionDecoder) withinRange(state *aircraftPosition, surface bool, at time.Time, latitude float64, longitude float64) bool {
+	if latitude < -90 || latitude > 90 {
+		return false
+	}
+
+	if !state.positionAt.IsZero() && at.Sub(state.positionAt) < referenceValidity {
+		return true
+	}
+
+	maxRange := airborneReceiverRange
+	if surface {
+		maxRange = surfaceReceiverRange
+	}
+
+	return Distance(d.receiverLat, d.receiverLon, latitude, longitude) <= maxRange
+}
+
+// prune forgets the aircraft we have not heard from in a while, at most once a
+// minute.
+func (d *PositionDecoder) prune(at time.Time) {
+	if at.Sub(d.lastPrune) < time.Minute {
+		return
+	}
+	d.lastPrune = at
+
+	for hexIdent, state := range d.aircraft {
+		last := state.evenAt
+		if state.oddAt.After(last) {
+			last = state.oddAt
+		}
+
+		if at.Sub(last) > referenceValidity {
+			delete(d.aircraft, hexIdent)
+		}
+	}
+}
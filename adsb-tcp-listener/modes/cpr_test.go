@@ -0,0 +1,182 @@
+package modes
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// encodeCPR is the transmitter side of CPR, for positions the tests pick.
+func encodeCPR(latitude float64, longitude float64, odd bool, surface bool) EncodedPosition {
+	span := cprSpan(surface)
+	zones := 60.0
+	if odd {
+		zones = 59
+	}
+
+	dLat := span / zones
+	yz := math.Floor(cprScale*positiveModulo(latitude, dLat)/dLat + 0.5)
+	rlat := dLat * (yz/cprScale + math.Floor(latitude/dLat))
+
+	ni := float64(NL(rlat))
+	if odd {
+		ni--
+	}
+	dLon := span / math.Max(ni, 1)
+	xz := math.Floor(cprScale*positiveModulo(longitude, dLon)/dLon + 0.5)
+
+	return EncodedPosition{
+		Odd:       odd,
+		Surface:   surface,
+		Latitude:  uint32(yz) & (cprScale - 1),
+		Longitude: uint32(xz) & (cprScale - 1),
+	}
+}
+
+func near(t *testing.T, latitude float64, longitude float64, wantLatitude float64, wantLongitude float64) {
+	t.Helper()
+
+	if math.Abs(latitude-wantLatitude) > 1e-4 || math.Abs(longitude-wantLongitude) > 1e-4 {
+		t.Errorf("got %.5f %.5f, want %.5f %.5f", latitude, longitude, wantLatitude, wantLongitude)
+	}
+}
+
+// the pair of 8D40621D58C382D690C8AC2863A7 and 8D40621D58C386435CC412692AD6
+var (
+	knownEven = EncodedPosition{Latitude: 93000, Longitude: 51372}
+	knownOdd  = EncodedPosition{Odd: true, Latitude: 74158, Longitude: 50194}
+)
+
+func TestDecodeGlobal(t *testing.T) {
+	latitude, longitude, ok := DecodeGlobal(knownEven, knownOdd, false, 0, 0)
+	if !ok {
+		t.Fatal("pair not decoded")
+	}
+	near(t, latitude, longitude, 52.25720, 3.91937)
+
+	latitude, longitude, ok = DecodeGlobal(knownEven, knownOdd, true, 0, 0)
+	if !ok {
+		t.Fatal("pair not decoded")
+	}
+	near(t, latitude, longitude, 52.26578, 3.93891)
+}
+
+func TestDecodeGlobalRejectsZoneChange(t *testing.T) {
+	// find where the number of longitude zones changes
+	boundary := 52.0
+	for NL(boundary) == NL(boundary+0.001) {
+		boundary += 0.001
+	}
+
+	even := encodeCPR(boundary-0.01, 4.5, false, false)
+	odd := encodeCPR(boundary+0.01, 4.5, true, false)
+	if _, _, ok := DecodeGlobal(even, odd, true, 0, 0); ok {
+		t.Fatalf("decoded a pair straddling the zone boundary at %v", boundary)
+	}
+
+	// the same pair on one side of it decodes
+	even = encodeCPR(boundary-0.02, 4.5, false, false)
+	odd = encodeCPR(boundary-0.01, 4.5, true, false)
+	latitude, longitude, ok := DecodeGlobal(even, odd, true, 0, 0)
+	if !ok {
+		t.Fatal("pair not decoded")
+	}
+	near(t, latitude, longitude, boundary-0.01, 4.5)
+}
+
+func TestDecodeLocal(t *testing.T) {
+	latitude, longitude := DecodeLocal(knownEven, 52.258, 3.918)
+	near(t, latitude, longitude, 52.25720, 3.91937)
+
+	// the other hemisphere and side of the antimeridian
+	position := encodeCPR(-33.9461, 151.1772, true, false)
+	latitude, longitude = DecodeLocal(position, -34.5, 150.5)
+	near(t, latitude, longitude, -33.9461, 151.1772)
+}
+
+func TestPositionDecoderPairWindow(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	decoder := NewPositionDecoder()
+	if _, _, ok := decoder.Decode("40621D", knownEven, start); ok {
+		t.Fatal("decoded a single frame without any reference")
+	}
+	latitude, longitude, ok := decoder.Decode("40621D", knownOdd, start.Add(time.Second))
+	if !ok {
+		t.Fatal("pair not decoded")
+	}
+	near(t, latitude, longitude, 52.26578, 3.93891)
+
+	// an even frame too late to pair with the odd one
+	decoder = NewPositionDecoder()
+	decoder.Decode("40621D", knownEven, start)
+	if _, _, ok := decoder.Decode("40621D", knownOdd, start.Add(airbornePairWindow+time.Second)); ok {
+		t.Fatal("decoded a pair further apart than the window")
+	}
+
+	// frames of another aircraft do not pair
+	decoder = NewPositionDecoder()
+	decoder.Decode("40621D", knownEven, start)
+	if _, _, ok := decoder.Decode("4840D6", knownOdd, start.Add(time.Second)); ok {
+		t.Fatal("paired frames of two aircraft")
+	}
+}
+
+func TestPositionDecoderLocalFallback(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	// from the last position, once the pair is stale
+	decoder := NewPositionDecoder()
+	decoder.Decode("40621D", knownEven, start)
+	decoder.Decode("40621D", knownOdd, start.Add(time.Second))
+
+	later := encodeCPR(52.30, 4.00, false, false)
+	latitude, longitude, ok := decoder.Decode("40621D", later, start.Add(time.Minute))
+	if !ok {
+		t.Fatal("no local decode from the last position")
+	}
+	near(t, latitude, longitude, 52.30, 4.00)
+
+	// the last position is too old to be a reference
+	if _, _, ok := decoder.Decode("40621D", later, start.Add(time.Hour)); ok {
+		t.Fatal("decoded from a position an hour old")
+	}
+
+	// from the receiver, for an aircraft in range
+	decoder = NewPositionDecoder()
+	decoder.SetReceiverLocation(52.3086, 4.7639)
+	latitude, longitude, ok = decoder.Decode("40621D", knownEven, start)
+	if !ok {
+		t.Fatal("no local decode from the receiver")
+	}
+	near(t, latitude, longitude, 52.25720, 3.91937)
+}
+
+func TestPositionDecoderSurface(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	even := encodeCPR(52.3086, 4.7639, false, true)
+	odd := encodeCPR(52.3090, 4.7645, true, true)
+
+	// ambiguous without a reference
+	decoder := NewPositionDecoder()
+	decoder.Decode("484175", even, start)
+	if _, _, ok := decoder.Decode("484175", odd, start.Add(time.Second)); ok {
+		t.Fatal("decoded a surface pair without a reference")
+	}
+
+	decoder = NewPositionDecoder()
+	decoder.SetReceiverLocation(52.30, 4.75)
+	decoder.Decode("484175", even, start)
+	latitude, longitude, ok := decoder.Decode("484175", odd, start.Add(time.Second))
+	if !ok {
+		t.Fatal("surface pair not decoded")
+	}
+	near(t, latitude, longitude, 52.3090, 4.7645)
+
+	// the global solution is picked in the quadrant of the reference
+	latitude, longitude, ok = DecodeGlobal(even, odd, false, 52.30, 4.75)
+	if !ok {
+		t.Fatal("surface pair not decoded")
+	}
+	near(t, latitude, longitude, 52.3086, 4.7639)
+}
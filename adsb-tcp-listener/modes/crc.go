@@ -0,0 +1,85 @@
+package modes
+
+const crcGenerator = 0xFFF409
+
+var (
+	crcTable = buildCRCTable()
+
+	// syndromes of a single flipped bit, keyed by syndrome, for both lengths
+	shortBitErrors = buildBitErrorTable(ShortFrameLength)
+	longBitErrors  = buildBitErrorTable(LongFrameLength)
+)
+
+func buildCRCTable() [256]uint32 {
+	var table [256]uint32
+
+	for i := range table {
+		crc := uint32(i) << 16
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x800000 != 0 {
+				crc = (crc << 1) ^ crcGenerator
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc & 0xFFFFFF
+	}
+
+	return table
+}
+
+func buildBitErrorTable(length int) map[uint32]int {
+	table := make(map[uint32]int, length*8)
+	frame := make([]byte, length)
+
+	// the downlink format bits are left alone, repairing them would turn the
+	// frame into something else entirely. A flipped parity bit is repaired
+	// too, the payload is intact then.
+	for bit := 5; bit < length*8; bit++ {
+		frame[bit/8] ^= 1 << (7 - bit%8)
+		table[Syndrome(frame)] = bit
+		frame[bit/8] ^= 1 << (7 - bit%8)
+	}
+
+	return table
+}
+
+// Checksum computes the CRC-24 of the frame payload, i.e. every byte but the
+// trailing 3 parity bytes.
+func Checksum(frame []byte) uint32 {
+	var crc uint32
+
+	for _, b := range frame[:len(frame)-3] {
+		crc = ((crc << 8) ^ crcTable[byte(crc>>16)^b]) & 0xFFFFFF
+	}
+
+	return crc
+}
+
+// Syndrome is the checksum XOR the transmitted parity. It is zero for an
+// intact DF11/DF17/DF18 frame and the aircraft address for the frames that
+// overlay it on the parity.
+func Syndrome(frame []byte) uint32 {
+	n := len(frame)
+	parity := uint32(frame[n-3])<<16 | uint32(frame[n-2])<<8 | uint32(frame[n-1])
+
+	return Checksum(frame) ^ parity
+}
+
+// CorrectSingleBitError flips the bit responsible for a non-zero syndrome, if
+// a single bit can explain it. It reports whether the frame was repaired.
+func CorrectSingleBitError(frame []byte) bool {
+	table := shortBitErrors
+	if len(frame) == LongFrameLength {
+		table = longBitErrors
+	}
+
+	bit, found := table[Syndrome(frame)]
+	if !found {
+		return false
+	}
+
+	frame[bit/8] ^= 1 << (7 - bit%8)
+
+	return true
+}
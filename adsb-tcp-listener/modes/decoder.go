@@ -0,0 +1,436 @@
+// Package modes decodes raw Mode-S frames, in particular the DF17/DF18
+// extended squitters that carry ADS-B.
+package modes
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+const (
+	ShortFrameLength = 7
+	LongFrameLength  = 14
+)
+
+var (
+	InvalidFrameLength        = errors.New("invalid frame length")
+	InvalidChecksum           = errors.New("invalid checksum")
+	UnsupportedDownlinkFormat = errors.New("unsupported downlink format")
+)
+
+const callsignCharset = "#ABCDEFGHIJKLMNOPQRSTUVWXYZ##### ###############0123456789######"
+
+// EncodedPosition is a CPR encoded position, as transmitted. It takes either
+// an even/odd pair or a reference position to turn it into coordinates.
+type EncodedPosition struct {
+	Odd       bool
+	Surface   bool
+	Latitude  uint32
+	Longitude uint32
+}
+
+type Message struct {
+	DownlinkFormat int
+	Address        uint32
+	// NonICAOAddress is set for DF18 transmitters using an anonymous or
+	// ground assigned address.
+	NonICAOAddress bool
+	TypeCode       int
+	// Corrected is set when a single bit error was repaired to get a valid CRC.
+	Corrected bool
+
+	Callsign        string
+	EmitterCategory string
+
+	Altitude             int
+	HasAltitude          bool
+	GeometricAltitude    int
+	HasGeometricAltitude bool
+
+	GroundSpeed float64
+	HasVelocity bool
+	// surface positions report the ground speed and the heading apart, either
+	// can be unknown
+	Track           float64
+	HasTrack        bool
+	VerticalRate    int
+	HasVerticalRate bool
+	OnGround        bool
+
+	Alert     bool
+	Emergency bool
+	Spi       bool
+
+	NIC     int
+	NACp    int
+	HasNACp bool
+
+	Position *EncodedPosition
+}
+
+// Decode validates the parity of a DF11, DF17 or DF18 frame, repairing a
+// single bit error when possible, and decodes its content. The frame passed
+// in is left untouched.
+func Decode(data []byte) (Message, error) {
+	if len(data) != ShortFrameLength && len(data) != LongFrameLength {
+		return Message{}, InvalidFrameLength
+	}
+
+	frame := make([]byte, len(data))
+	copy(frame, data)
+
+	message := Message{
+		DownlinkFormat: int(frame[0] >> 3),
+	}
+
+	switch message.DownlinkFormat {
+	case 11:
+		if len(frame) != ShortFrameLength {
+			return Message{}, InvalidFrameLength
+		}
+
+		// all-call replies may carry an interrogator code in the low 7 bits
+		if Syndrome(frame)&^0x7F != 0 {
+			return Message{}, InvalidChecksum
+		}
+	case 17, 18:
+		if len(frame) != LongFrameLength {
+			return Message{}, InvalidFrameLength
+		}
+
+		if Syndrome(frame) != 0 {
+			if !CorrectSingleBitError(frame) {
+				return Message{}, InvalidChecksum
+			}
+			message.Corrected = true
+		}
+	default:
+		return Message{}, UnsupportedDownlinkFormat
+	}
+
+	message.Address = uint32(frame[1])<<16 | uint32(frame[2])<<8 | uint32(frame[3])
+
+	if message.DownlinkFormat == 11 {
+		return message, nil
+	}
+
+	// DF18 control fields 3, 4 and 7 are not in the extended squitter format
+	if message.DownlinkFormat == 18 {
+		controlField := frame[0] & 0x07
+		if controlField == 3 || controlField == 4 || controlField == 7 {
+			return Message{}, UnsupportedDownlinkFormat
+		}
+
+		message.NonICAOAddress = controlField == 1 || controlField == 5
+	}
+
+	var me uint64
+	for _, b := range frame[4:11] {
+		me = me<<8 | uint64(b)
+	}
+
+	message.TypeCode = int(bits(me, 1, 5))
+
+	switch {
+	case message.TypeCode >= 1 && message.TypeCode <= 4:
+		decodeIdentification(me, &message)
+	case message.TypeCode >= 5 && message.TypeCode <= 8:
+		decodeSurfacePosition(me, &message)
+	case message.TypeCode >= 9 && message.TypeCode <= 18, message.TypeCode >= 20 && message.TypeCode <= 22:
+		decodeAirbornePosition(me, &message)
+	case message.TypeCode == 19:
+		decodeVelocity(me, &message)
+	case message.TypeCode == 29:
+		decodeTargetState(me, &message)
+	case message.TypeCode == 31:
+		decodeOperationalStatus(me, &message)
+	}
+
+	return message, nil
+}
+
+// bits extracts ME bits first to last, numbered from 1 like in the spec.
+func bits(me uint64, first int, last int) uint64 {
+	return (me >> (56 - last)) & (1<<(last-first+1) - 1)
+}
+
+func decodeIdentification(me uint64, message *Message) {
+	message.EmitterCategory = string(rune('A'+4-message.TypeCode)) + string(rune('0'+bits(me, 6, 8)))
+
+	callsign := make([]byte, 8)
+	for i := range callsign {
+		first := 9 + i*6
+		callsign[i] = callsignCharset[bits(me, first, first+5)]
+	}
+
+	message.Callsign = strings.TrimRight(strings.ReplaceAll(string(callsign), "#", ""), " ")
+}
+
+func decodeSurfacePosition(me uint64, message *Message) {
+	message.OnGround = true
+	message.NIC = nic(message.TypeCode, false)
+
+	movement := int(bits(me, 6, 12))
+	if speed, known := groundMovement(movement); known {
+		message.GroundSpeed = speed
+		message.HasVelocity = true
+	}
+
+	if bits(me, 13, 13) == 1 {
+		message.Track = float64(bits(me, 14, 20)) * 360 / 128
+		message.HasTrack = true
+	}
+
+	message.Position = &EncodedPosition{
+		Odd:       bits(me, 22, 22) == 1,
+		Surface:   true,
+		Latitude:  uint32(bits(me, 23, 39)),
+		Longitude: uint32(bits(me, 40, 56)),
+	}
+}
+
+func decodeAirbornePosition(me uint64, message *Message) {
+	surveillanceStatus := bits(me, 6, 7)
+	message.Alert = surveillanceStatus == 1 || surveillanceStatus == 2
+	message.Emergency = surveillanceStatus == 1
+	message.Spi = surveillanceStatus == 3
+	message.NIC = nic(message.TypeCode, bits(me, 8, 8) == 1)
+
+	altitude, known := decodeAC12(int(bits(me, 9, 20)))
+	if message.TypeCode >= 20 {
+		message.GeometricAltitude = altitude
+		message.HasGeometricAltitude = known
+	} else {
+		message.Altitude = altitude
+		message.HasAltitude = known
+	}
+
+	message.Position = &EncodedPosition{
+		Odd:       bits(me, 22, 22) == 1,
+		Latitude:  uint32(bits(me, 23, 39)),
+		Longitude: uint32(bits(me, 40, 56)),
+	}
+}
+
+func decodeVelocity(me uint64, message *Message) {
+	subtype := bits(me, 6, 8)
+
+	if verticalRate := int(bits(me, 38, 46)); verticalRate != 0 {
+		message.VerticalRate = (verticalRate - 1) * 64
+		if bits(me, 37, 37) == 1 {
+			message.VerticalRate = -message.VerticalRate
+		}
+		message.HasVerticalRate = true
+	}
+
+	// subtypes 3 and 4 report airspeed and heading, not ground velocity
+	if subtype != 1 && subtype != 2 {
+		return
+	}
+
+	eastWest := float64(bits(me, 15, 24))
+	northSouth := float64(bits(me, 26, 35))
+	if eastWest == 0 || northSouth == 0 {
+		return
+	}
+
+	multiplier := 1.0
+	if subtype == 2 {
+		multiplier = 4
+	}
+
+	vx := (eastWest - 1) * multiplier
+	if bits(me, 14, 14) == 1 {
+		vx = -vx
+	}
+
+	vy := (northSouth - 1) * multiplier
+	if bits(me, 25, 25) == 1 {
+		vy = -vy
+	}
+
+	message.GroundSpeed = math.Hypot(vx, vy)
+	message.Track = math.Mod(math.Atan2(vx, vy)*180/math.Pi+360, 360)
+	message.HasVelocity = true
+	message.HasTrack = true
+}
+
+func decodeTargetState(me uint64, message *Message) {
+	// only the version 2 layout (subtype 1) carries NACp
+	if bits(me, 6, 7) != 1 {
+		return
+	}
+
+	message.NACp = int(bits(me, 40, 43))
+	message.HasNACp = true
+}
+
+func decodeOperationalStatus(me uint64, message *Message) {
+	// version 0 transmitters do not report NACp here
+	if bits(me, 41, 43) == 0 {
+		return
+	}
+
+	message.NACp = int(bits(me, 45, 48))
+	message.HasNACp = true
+}
+
+// nic derives the navigation integrity category from the position type code.
+// Without the supplement bits from the operational status message we assume
+// the lower of the two possible values.
+func nic(typeCode int, supplementB bool) int {
+	switch typeCode {
+	case 5, 9, 20:
+		return 11
+	case 6, 10, 21:
+		return 10
+	case 7:
+		return 8
+	case 11:
+		if supplementB {
+			return 9
+		}
+		return 8
+	case 12:
+		return 7
+	case 13:
+		return 6
+	case 14:
+		return 5
+	case 15:
+		return 4
+	case 16:
+		if supplementB {
+			return 3
+		}
+		return 2
+	case 17:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// groundMovement decodes the quantised surface speed, in knots.
+func groundMovement(movement int) (float64, bool) {
+	switch {
+	case movement == 1:
+		return 0, true
+	case movement >= 2 && movement <= 8:
+		return 0.125 + float64(movement-2)*0.125, true
+	case movement >= 9 && movement <= 12:
+		return 1 + float64(movement-9)*0.25, true
+	case movement >= 13 && movement <= 38:
+		return 2 + float64(movement-13)*0.5, true
+	case movement >= 39 && movement <= 93:
+		return 15 + float64(movement-39), true
+	case movement >= 94 && movement <= 108:
+		return 70 + float64(movement-94)*2, true
+	case movement >= 109 && movement <= 123:
+		return 100 + float64(movement-109)*5, true
+	case movement == 124:
+		return 175, true
+	default:
+		return 0, false
+	}
+}
+
+// decodeAC12 decodes the 12 bit altitude field of a position message, in feet.
+func decodeAC12(field int) (int, bool) {
+	if field == 0 {
+		return 0, false
+	}
+
+	// Q bit set: 25 ft increments
+	if field&0x10 != 0 {
+		n := ((field & 0x0FE0) >> 1) | (field & 0x000F)
+		return n*25 - 1000, true
+	}
+
+	// Q bit clear: Gillham coded in 100 ft increments, put the M bit back to
+	// make it a 13 bit field
+	hundreds, valid := gillhamToAltitude(((field & 0x0FC0) << 1) | (field & 0x003F))
+	if !valid {
+		return 0, false
+	}
+
+	return hundreds * 100, true
+}
+
+// gillhamToAltitude decodes a 13 bit Gillham (Gray) coded altitude into
+// hundreds of feet.
+func gillhamToAltitude(field int) (int, bool) {
+	// reorder the interleaved C1 A1 C2 A2 C4 A4 M B1 D1 B2 D2 B4 D4 bits
+	var code int
+	for _, mapping := range [][2]int{
+		{0x1000, 0x0010}, // C1
+		{0x0800, 0x1000}, // A1
+		{0x0400, 0x0020}, // C2
+		{0x0200, 0x2000}, // A2
+		{0x0100, 0x0040}, // C4
+		{0x0080, 0x4000}, // A4
+		{0x0020, 0x0100}, // B1
+		{0x0010, 0x0001}, // D1
+		{0x0008, 0x0200}, // B2
+		{0x0004, 0x0002}, // D2
+		{0x0002, 0x0400}, // B4
+		{0x0001, 0x0004}, // D4
+	} {
+		if field&mapping[0] != 0 {
+			code |= mapping[1]
+		}
+	}
+
+	// D1 is never used for altitude and at least one C bit must be set
+	if code&0x8889 != 0 || code&0x00F0 == 0 {
+		return 0, false
+	}
+
+	oneHundreds := 0
+	if code&0x0010 != 0 {
+		oneHundreds ^= 0x007
+	}
+	if code&0x0020 != 0 {
+		oneHundreds ^= 0x003
+	}
+	if code&0x0040 != 0 {
+		oneHundreds ^= 0x001
+	}
+
+	// 7 is not a valid code, it stands for 5
+	if oneHundreds&5 == 5 {
+		oneHundreds ^= 2
+	}
+
+	if oneHundreds > 5 {
+		return 0, false
+	}
+
+	fiveHundreds := 0
+	for _, mapping := range [][2]int{
+		{0x0002, 0x0FF}, // D2
+		{0x0004, 0x07F}, // D4
+		{0x1000, 0x03F}, // A1
+		{0x2000, 0x01F}, // A2
+		{0x4000, 0x00F}, // A4
+		{0x0100, 0x007}, // B1
+		{0x0200, 0x003}, // B2
+		{0x0400, 0x001}, // B4
+	} {
+		if code&mapping[0] != 0 {
+			fiveHundreds ^= mapping[1]
+		}
+	}
+
+	if fiveHundreds&1 != 0 {
+		oneHundreds = 6 - oneHundreds
+	}
+
+	hundreds := fiveHundreds*5 + oneHundreds - 13
+	if hundreds < -12 {
+		return 0, false
+	}
+
+	return hundreds, true
+}
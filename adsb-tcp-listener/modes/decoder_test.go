@@ -0,0 +1,208 @@
+package modes
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+)
+
+func frame(t *testing.T, hexFrame string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(hexFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// extendedSquitter builds a DF17 frame with a valid parity around the ME
+// field.
+func extendedSquitter(address uint32, me uint64) []byte {
+	data := []byte{17<<3 | 5, byte(address >> 16), byte(address >> 8), byte(address)}
+	for shift := 48; shift >= 0; shift -= 8 {
+		data = append(data, byte(me>>shift))
+	}
+	data = append(data, 0, 0, 0)
+
+	crc := Checksum(data)
+	data[11], data[12], data[13] = byte(crc>>16), byte(crc>>8), byte(crc)
+
+	return data
+}
+
+// setBits sets the ME bits first to last, numbered from 1 like in the spec.
+func setBits(me uint64, first int, last int, value uint64) uint64 {
+	return me | value<<(56-last)
+}
+
+func flipBit(data []byte, bit int) []byte {
+	flipped := append([]byte(nil), data...)
+	flipped[bit/8] ^= 1 << (7 - bit%8)
+
+	return flipped
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		check func(t *testing.T, message Message)
+	}{
+		{
+			name:  "identification",
+			frame: "8D4840D6202CC371C32CE0576098",
+			check: func(t *testing.T, message Message) {
+				if message.Address != 0x4840D6 || message.TypeCode != 4 || message.Callsign != "KLM1023" || message.EmitterCategory != "A0" {
+					t.Errorf("got %06X TC %d %q %q", message.Address, message.TypeCode, message.Callsign, message.EmitterCategory)
+				}
+			},
+		},
+		{
+			name:  "airborne position",
+			frame: "8D40621D58C382D690C8AC2863A7",
+			check: func(t *testing.T, message Message) {
+				if !message.HasAltitude || message.Altitude != 38000 {
+					t.Errorf("altitude %d %v, want 38000 ft", message.Altitude, message.HasAltitude)
+				}
+				want := EncodedPosition{Odd: false, Latitude: 93000, Longitude: 51372}
+				if message.Position == nil || *message.Position != want {
+					t.Errorf("position %+v, want %+v", message.Position, want)
+				}
+				if message.OnGround || message.NIC != 8 {
+					t.Errorf("on ground %v NIC %d", message.OnGround, message.NIC)
+				}
+			},
+		},
+		{
+			name:  "airborne velocity",
+			frame: "8D485020994409940838175B284F",
+			check: func(t *testing.T, message Message) {
+				if !message.HasVelocity || math.Abs(message.GroundSpeed-159.2) > 0.05 {
+					t.Errorf("ground speed %v %v, want 159.2 kt", message.GroundSpeed, message.HasVelocity)
+				}
+				if !message.HasTrack || math.Abs(message.Track-182.88) > 0.005 {
+					t.Errorf("track %v %v, want 182.88°", message.Track, message.HasTrack)
+				}
+				if !message.HasVerticalRate || message.VerticalRate != -832 {
+					t.Errorf("vertical rate %v %v, want -832 fpm", message.VerticalRate, message.HasVerticalRate)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := Decode(frame(t, test.frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.DownlinkFormat != 17 || message.Corrected {
+				t.Errorf("DF %d, corrected %v", message.DownlinkFormat, message.Corrected)
+			}
+			test.check(t, message)
+		})
+	}
+}
+
+func TestDecodeSurfacePosition(t *testing.T) {
+	// TC 6, 17 kt, odd frame
+	me := setBits(0, 1, 5, 6)
+	me = setBits(me, 6, 12, 41)
+	me = setBits(me, 22, 22, 1)
+	me = setBits(me, 23, 39, 39195)
+	me = setBits(me, 40, 56, 110320)
+
+	message, err := Decode(extendedSquitter(0x484175, me))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !message.OnGround || !message.HasVelocity || message.GroundSpeed != 17 {
+		t.Errorf("on ground %v, speed %v %v", message.OnGround, message.GroundSpeed, message.HasVelocity)
+	}
+	// the heading status bit is clear, the heading is unknown
+	if message.HasTrack {
+		t.Errorf("heading %v reported without its status bit", message.Track)
+	}
+	want := EncodedPosition{Odd: true, Surface: true, Latitude: 39195, Longitude: 110320}
+	if message.Position == nil || *message.Position != want {
+		t.Errorf("position %+v, want %+v", message.Position, want)
+	}
+
+	// with the heading: 64/128 of a turn
+	me = setBits(me, 13, 13, 1)
+	me = setBits(me, 14, 20, 64)
+	message, err = Decode(extendedSquitter(0x484175, me))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !message.HasTrack || message.Track != 180 {
+		t.Errorf("heading %v %v, want 180°", message.Track, message.HasTrack)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	for _, hexFrame := range []string{"8D4840D6202CC371C32CE0576098", "8D40621D58C382D690C8AC2863A7", "8D485020994409940838175B284F"} {
+		if syndrome := Syndrome(frame(t, hexFrame)); syndrome != 0 {
+			t.Errorf("%v: syndrome %06X", hexFrame, syndrome)
+		}
+	}
+
+	// DF11 replies overlay the interrogator code on the parity
+	reply := frame(t, "5D4840D6000000")
+	crc := Checksum(reply)
+	reply[4], reply[5], reply[6] = byte(crc>>16), byte(crc>>8), byte(crc)^0x05
+	message, err := Decode(reply)
+	if err != nil || message.DownlinkFormat != 11 || message.Address != 0x4840D6 {
+		t.Fatalf("got %+v, %v", message, err)
+	}
+}
+
+func TestDecodeCorrectsSingleBitError(t *testing.T) {
+	intact := frame(t, "8D4840D6202CC371C32CE0576098")
+
+	// a bit of the address, of the ME field and of the parity
+	for _, bit := range []int{10, 40, 60, 100} {
+		damaged := flipBit(intact, bit)
+
+		message, err := Decode(damaged)
+		if err != nil {
+			t.Fatalf("bit %d: %v", bit, err)
+		}
+		if !message.Corrected || message.Address != 0x4840D6 || message.Callsign != "KLM1023" {
+			t.Errorf("bit %d: corrected %v, %06X %q", bit, message.Corrected, message.Address, message.Callsign)
+		}
+		// the frame passed in is left alone
+		if Syndrome(damaged) == 0 {
+			t.Errorf("bit %d: the frame passed in was repaired in place", bit)
+		}
+	}
+}
+
+func TestDecodeRejectsTwoBitErrors(t *testing.T) {
+	intact := frame(t, "8D4840D6202CC371C32CE0576098")
+
+	for _, bits := range [][2]int{{10, 11}, {40, 60}, {33, 90}} {
+		damaged := flipBit(flipBit(intact, bits[0]), bits[1])
+
+		_, err := Decode(damaged)
+		if !errors.Is(err, InvalidChecksum) {
+			t.Errorf("bits %v: got %v, want InvalidChecksum", bits, err)
+		}
+	}
+}
+
+func TestDecodeRejectsFrames(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"too short":        make([]byte, 5),
+		"DF17 short":       frame(t, "8D4840D6202CC3"),
+		"DF4 surveillance": frame(t, "20000F1F684A6C"),
+	} {
+		_, err := Decode(data)
+		if !errors.Is(err, InvalidFrameLength) && !errors.Is(err, UnsupportedDownlinkFormat) {
+			t.Errorf("%v: got %v", name, err)
+		}
+	}
+}
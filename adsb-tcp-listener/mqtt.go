@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+var (
+	InvalidQoS    = errors.New("invalid MQTT QoS")
+	BrokerTimeout = errors.New("timed out waiting for the MQTT broker")
+)
+
+// how many publishings can wait for the broker's acknowledgement at once,
+// above QoS 0
+const mqttInflightWindow = 256
+
+// the characters that cannot be part of a topic level
+var topicReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// MQTTSink publishes every message on its own topic,
+// {prefix}/{receiver}/{hex_ident}/{transmission_type}, so a subscriber can
+// follow one aircraft (adsb/+/4CA2D6/#) or one receiver (adsb/north/#). Records
+// other than MSG use their type as last level. Positions can be retained, a new
+// subscriber then gets the last known position of every aircraft at once. A
+// retained position is cleared when BaseStation removes the aircraft (STA RM
+// or AD), or once no new one came for RetainTTL.
+//
+// Messages wait in a buffer while the broker is unavailable, the newest are
+// dropped once it is full. Above QoS 0 up to mqttInflightWindow publishings
+// wait for their acknowledgement at once, those failing are counted as
+// dropped.
+type MQTTSink struct {
+	Broker          string
+	ClientId        string
+	TopicPrefix     string
+	QoS             byte
+	RetainPositions bool
+	// how long a retained position outlives the last one received, forever
+	// when 0
+	RetainTTL  time.Duration
+	WireFormat string
+	client     mqtt.Client
+	// when each retained topic was last published, only used by Start
+	retained map[string]time.Time
+	buffer   chan schema.ADSBMessage
+	// a slot per publishing waiting for its acknowledgement
+	inflight     chan struct{}
+	closeChannel chan struct{}
+	done         chan struct{}
+	dropped      atomic.Uint64
+	lastDropLog  atomic.Int64
+}
+
+func NewMQTTSink(broker string, bufferSize int) *MQTTSink {
+	return &MQTTSink{
+		Broker:          broker,
+		ClientId:        "adsb-tcp-listener",
+		TopicPrefix:     "adsb",
+		RetainPositions: true,
+		RetainTTL:       5 * time.Minute,
+		WireFormat:      schema.WireFormatJSON,
+		retained:        make(map[string]time.Time),
+		buffer:          make(chan schema.ADSBMessage, bufferSize),
+		inflight:        make(chan struct{}, mqttInflightWindow),
+		closeChannel:    make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+}
+
+func checkQoS(qos string) (byte, error) {
+	if qos == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.Atoi(qos)
+	if err != nil || value < 0 || value > 2 {
+		return 0, InvalidQoS
+	}
+
+	return byte(value), nil
+}
+
+// Connect connects to the broker. The client keeps retrying in the background
+// when it fails, and reconnects on its own when the connection drops.
+func (sink *MQTTSink) Connect() error {
+	options := mqtt.NewClientOptions().
+		AddBroker(sink.Broker).
+		SetClientID(sink.ClientId).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Println("lost connection to MQTT broker", err)
+		}).
+		SetOnConnectHandler(func(_ mqtt.Client) {
+			log.Println("Connected to MQTT broker")
+		})
+
+	sink.client = mqtt.NewClient(options)
+
+	token := sink.client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		return BrokerTimeout
+	}
+
+	return token.Error()
+}
+
+// Start publishes the buffered messages until the sink is closed, and clears
+// the retained positions past their TTL.
+func (sink *MQTTSink) Start() {
+	defer close(sink.done)
+
+	var expiry <-chan time.Time
+	if sink.RetainPositions && sink.RetainTTL > 0 {
+		ticker := time.NewTicker(max(sink.RetainTTL/4, time.Second))
+		defer ticker.Stop()
+		expiry = ticker.C
+	}
+
+	for {
+		select {
+		case <-sink.closeChannel:
+			return
+		case message := <-sink.buffer:
+			sink.publish(message)
+		case now := <-expiry:
+			sink.expireRetained(now)
+		}
+	}
+}
+
+// clearRetained removes the retained topics starting with prefix from the
+// broker, an empty retained message deletes the one it holds.
+func (sink *MQTTSink) clearRetained(prefix string) {
+	for topic := range sink.retained {
+		if strings.HasPrefix(topic, prefix) {
+			sink.client.Publish(topic, sink.QoS, true, []byte{})
+			delete(sink.retained, topic)
+		}
+	}
+}
+
+func (sink *MQTTSink) expireRetained(now time.Time) {
+	for topic, published := range sink.retained {
+		if now.Sub(published) > sink.RetainTTL {
+			sink.client.Publish(topic, sink.QoS, true, []byte{})
+			delete(sink.retained, topic)
+		}
+	}
+}
+
+func (sink *MQTTSink) publish(message schema.ADSBMessage) {
+	_, payload, err := schema.Encode(sink.WireFormat, []schema.ADSBMessage{message})
+	if err != nil {
+		log.Println("failed to encode message, dropping it", err)
+		return
+	}
+
+	topic := sink.topic(message)
+	retained := sink.RetainPositions && message.Latitude.Valid && message.Longitude.Valid
+	token := sink.client.Publish(topic, sink.QoS, retained, payload)
+
+	if retained {
+		sink.retained[topic] = time.Now()
+	}
+	// the aircraft is gone, its last position with it
+	removed := message.Status == schema.StatusRemoved || message.Status == schema.StatusDeleted
+	if message.MessageType == schema.MessageTypeStatusChange && removed {
+		sink.clearRetained(sink.aircraftTopic(message) + "/")
+	}
+
+	// at QoS 0 there is nothing to wait for
+	if sink.QoS == 0 {
+		return
+	}
+
+	// the acknowledgements are waited for aside, publishing only waits when
+	// the window is full
+	select {
+	case sink.inflight <- struct{}{}:
+	case <-sink.closeChannel:
+		return
+	}
+	go sink.acknowledged(token)
+}
+
+// acknowledged waits for the broker to acknowledge a publishing and frees its
+// slot in the window.
+func (sink *MQTTSink) acknowledged(token mqtt.Token) {
+	defer func() { <-sink.inflight }()
+
+	if !token.WaitTimeout(10 * time.Second) {
+		sink.drop(BrokerTimeout)
+	} else if token.Error() != nil {
+		sink.drop(token.Error())
+	}
+}
+
+func (sink *MQTTSink) topic(message schema.ADSBMessage) string {
+	kind := message.MessageType
+	if message.MessageType == schema.MessageTypeTransmission {
+		kind = strconv.Itoa(message.TransmissionType)
+	}
+
+	return sink.aircraftTopic(message) + "/" + kind
+}
+
+// aircraftTopic is the topic of an aircraft heard by a receiver, without the
+// last level.
+func (sink *MQTTSink) aircraftTopic(message schema.ADSBMessage) string {
+	return sink.TopicPrefix + "/" + topicLevel(message.ReceiverId) + "/" + topicLevel(message.HexIdent)
+}
+
+// topicLevel makes a value usable as a single topic level, receiver ids of
+// feeders contain slashes.
+func topicLevel(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+
+	return topicReplacer.Replace(value)
+}
+
+func (sink *MQTTSink) SendMessage(message schema.ADSBMessage) {
+	select {
+	case sink.buffer <- message:
+	default:
+		sink.drop(nil)
+	}
+}
+
+func (sink *MQTTSink) drop(err error) {
+	dropped := sink.dropped.Add(1)
+	if rateLimited(&sink.lastDropLog, 10*time.Second) {
+		return
+	}
+
+	if err != nil {
+		log.Println("failed to publish to MQTT, dropped", dropped, "messages so far", err)
+	} else {
+		log.Println("MQTT buffer full, dropped", dropped, "messages so far")
+	}
+}
+
+func (sink *MQTTSink) Dropped() uint64 {
+	return sink.dropped.Load()
+}
+
+// Close gives the client a second to send what it is still holding.
+func (sink *MQTTSink) Close() error {
+	close(sink.closeChannel)
+	<-sink.done
+
+	if sink.client != nil {
+		sink.client.Disconnect(1000)
+	}
+
+	return nil
+}
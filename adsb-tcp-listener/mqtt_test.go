@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+type publishing struct {
+	topic    string
+	retained bool
+	empty    bool
+}
+
+// recordingClient keeps what is published instead of sending it, the sink
+// only publishes at QoS 0 in these tests and never looks at the token.
+type recordingClient struct {
+	mqtt.Client
+	published []publishing
+}
+
+func (client *recordingClient) Publish(topic string, _ byte, retained bool, payload interface{}) mqtt.Token {
+	client.published = append(client.published, publishing{topic, retained, len(payload.([]byte)) == 0})
+	return nil
+}
+
+func (client *recordingClient) cleared() []string {
+	var topics []string
+	for _, published := range client.published {
+		if published.retained && published.empty {
+			topics = append(topics, published.topic)
+		}
+	}
+
+	return topics
+}
+
+func positionOf(hexIdent string) schema.ADSBMessage {
+	return schema.ADSBMessage{
+		MessageType:      schema.MessageTypeTransmission,
+		TransmissionType: schema.TranmissionTypeAirbornePosition,
+		HexIdent:         hexIdent,
+		ReceiverId:       "north",
+		Latitude:         schema.Some(52.3086),
+		Longitude:        schema.Some(4.7639),
+	}
+}
+
+func TestMQTTSinkClearsRemovedAircraft(t *testing.T) {
+	client := &recordingClient{}
+	sink := NewMQTTSink("", 1)
+	sink.client = client
+
+	sink.publish(positionOf("4CA2D6"))
+	sink.publish(positionOf("3C6444"))
+	if len(client.published) != 2 || !client.published[0].retained {
+		t.Fatalf("got %+v, want two retained positions", client.published)
+	}
+
+	sink.publish(schema.ADSBMessage{MessageType: schema.MessageTypeStatusChange, HexIdent: "4CA2D6", ReceiverId: "north", Status: schema.StatusSignalLost})
+	if cleared := client.cleared(); len(cleared) != 0 {
+		t.Fatalf("signal lost cleared %v", cleared)
+	}
+
+	sink.publish(schema.ADSBMessage{MessageType: schema.MessageTypeStatusChange, HexIdent: "4CA2D6", ReceiverId: "north", Status: schema.StatusRemoved})
+	cleared := client.cleared()
+	if len(cleared) != 1 || cleared[0] != "adsb/north/4CA2D6/3" {
+		t.Fatalf("cleared %v, want the position of 4CA2D6", cleared)
+	}
+
+	// cleared once, the other aircraft is still retained
+	sink.publish(schema.ADSBMessage{MessageType: schema.MessageTypeStatusChange, HexIdent: "4CA2D6", ReceiverId: "north", Status: schema.StatusDeleted})
+	if len(client.cleared()) != 1 || len(sink.retained) != 1 {
+		t.Fatalf("cleared %v, still retained %v", client.cleared(), sink.retained)
+	}
+}
+
+func TestMQTTSinkExpiresRetainedPositions(t *testing.T) {
+	client := &recordingClient{}
+	sink := NewMQTTSink("", 1)
+	sink.client = client
+	sink.RetainTTL = time.Minute
+
+	sink.publish(positionOf("4CA2D6"))
+	sink.publish(positionOf("3C6444"))
+	sink.retained["adsb/north/4CA2D6/3"] = time.Now().Add(-2 * time.Minute)
+
+	sink.expireRetained(time.Now())
+	cleared := client.cleared()
+	if len(cleared) != 1 || cleared[0] != "adsb/north/4CA2D6/3" {
+		t.Fatalf("cleared %v, want the position of 4CA2D6", cleared)
+	}
+	if _, ok := sink.retained["adsb/north/3C6444/3"]; !ok {
+		t.Fatal("the recent position of 3C6444 expired")
+	}
+}
+
+// pendingToken is a publishing the broker has not acknowledged yet.
+type pendingToken struct {
+	done chan struct{}
+	err  error
+}
+
+func (token *pendingToken) Wait() bool {
+	<-token.done
+	return true
+}
+
+func (token *pendingToken) WaitTimeout(timeout time.Duration) bool {
+	select {
+	case <-token.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (token *pendingToken) Done() <-chan struct{} {
+	return token.done
+}
+
+func (token *pendingToken) Error() error {
+	return token.err
+}
+
+// acknowledgingClient hands out a pending token per publishing.
+type acknowledgingClient struct {
+	mqtt.Client
+	tokens chan *pendingToken
+}
+
+func (client *acknowledgingClient) Publish(_ string, _ byte, _ bool, _ interface{}) mqtt.Token {
+	token := &pendingToken{done: make(chan struct{})}
+	client.tokens <- token
+	return token
+}
+
+func TestMQTTSinkPublishesWithoutWaitingForAcknowledgements(t *testing.T) {
+	client := &acknowledgingClient{tokens: make(chan *pendingToken, 10)}
+	sink := NewMQTTSink("", 10)
+	sink.client = client
+	sink.QoS = 1
+	sink.inflight = make(chan struct{}, 2)
+
+	// the window holds two unacknowledged publishings
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < 3; i++ {
+			sink.publish(positionOf("4CA2D6"))
+		}
+	}()
+
+	first, second := <-client.tokens, <-client.tokens
+	third := <-client.tokens
+	select {
+	case <-published:
+		t.Fatal("published past the window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a failure frees its slot and is only counted
+	first.err = errors.New("connection lost")
+	close(first.done)
+	<-published
+
+	close(second.done)
+	close(third.done)
+	deadline := time.Now().Add(time.Second)
+	for len(sink.inflight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(sink.inflight) != 0 || sink.Dropped() != 1 {
+		t.Errorf("%d publishings in flight, %d dropped, want 0 and 1", len(sink.inflight), sink.Dropped())
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-schema/broker"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// the characters that cannot be part of a subject token
+var subjectReplacer = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "\t", "_")
+
+// NATSSink publishes every message to a JetStream stream, on the subject
+// {subject}.{hex_ident}. It needs no RabbitMQ cluster, a single NATS server
+// does.
+//
+// Messages wait in a buffer while the server is unavailable, the newest are
+// dropped once it is full or when the server does not acknowledge them.
+type NATSSink struct {
+	URL          string
+	Stream       string
+	Subject      string
+	WireFormat   string
+	connection   *nats.Conn
+	jetStream    jetstream.JetStream
+	buffer       chan schema.ADSBMessage
+	closeChannel chan struct{}
+	done         chan struct{}
+	dropped      atomic.Uint64
+	lastDropLog  atomic.Int64
+}
+
+func NewNATSSink(url string, bufferSize int) *NATSSink {
+	return &NATSSink{
+		URL:          url,
+		Stream:       "ADSB",
+		Subject:      "adsb",
+		WireFormat:   schema.WireFormatJSON,
+		buffer:       make(chan schema.ADSBMessage, bufferSize),
+		closeChannel: make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Connect connects to the server and declares the stream. The client keeps
+// retrying in the background when it fails, and declares the stream again
+// every time it connects.
+func (sink *NATSSink) Connect() error {
+	connection, err := nats.Connect(sink.URL,
+		nats.Name("adsb-tcp-listener"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			// err is nil when the connection is closed on purpose
+			if err != nil {
+				log.Println("lost connection to NATS", err)
+			}
+		}),
+		nats.ConnectHandler(func(connection *nats.Conn) {
+			log.Println("Connected to NATS")
+			_ = createStream(connection, broker.NATSStreamConfig(sink.Stream, sink.Subject))
+		}),
+		nats.ReconnectHandler(func(connection *nats.Conn) {
+			log.Println("Reconnected to NATS")
+			_ = createStream(connection, broker.NATSStreamConfig(sink.Stream, sink.Subject))
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	sink.connection = connection
+
+	sink.jetStream, err = jetstream.New(connection, jetstream.WithPublishAsyncErrHandler(func(_ jetstream.JetStream, _ *nats.Msg, err error) {
+		sink.drop(err)
+	}))
+	if err != nil {
+		return err
+	}
+
+	if !connection.IsConnected() {
+		return nats.ErrNoServers
+	}
+
+	return createStream(connection, broker.NATSStreamConfig(sink.Stream, sink.Subject))
+}
+
+func createStream(connection *nats.Conn, config jetstream.StreamConfig) error {
+	jetStream, err := jetstream.New(connection)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = jetStream.CreateOrUpdateStream(ctx, config)
+	if err != nil {
+		log.Println("failed to declare the NATS stream", config.Name, err)
+	}
+
+	return err
+}
+
+// Start publishes the buffered messages until the sink is closed.
+func (sink *NATSSink) Start() {
+	defer close(sink.done)
+
+	for {
+		select {
+		case <-sink.closeChannel:
+			return
+		case message := <-sink.buffer:
+			sink.publish(message)
+		}
+	}
+}
+
+func (sink *NATSSink) publish(message schema.ADSBMessage) {
+	// Connect failed for good, a bad URL
+	if sink.jetStream == nil {
+		sink.drop(nats.ErrInvalidConnection)
+		return
+	}
+
+	contentType, body, err := schema.Encode(sink.WireFormat, []schema.ADSBMessage{message})
+	if err != nil {
+		log.Println("failed to encode message, dropping it", err)
+		return
+	}
+
+	msg := nats.NewMsg(sink.Subject + "." + subjectToken(message.HexIdent))
+	msg.Header.Set(broker.NATSContentTypeHeader, contentType)
+	msg.Data = body
+
+	// blocks for a moment when too many messages wait for their
+	// acknowledgement, and fails past that
+	_, err = sink.jetStream.PublishMsgAsync(msg)
+	if err != nil {
+		sink.drop(err)
+	}
+}
+
+// subjectToken makes a value usable as a single subject token.
+func subjectToken(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+
+	return subjectReplacer.Replace(value)
+}
+
+func (sink *NATSSink) SendMessage(message schema.ADSBMessage) {
+	select {
+	case sink.buffer <- message:
+	default:
+		sink.drop(nil)
+	}
+}
+
+func (sink *NATSSink) drop(err error) {
+	dropped := sink.dropped.Add(1)
+	if rateLimited(&sink.lastDropLog, 10*time.Second) {
+		return
+	}
+
+	if err != nil {
+		log.Println("failed to publish to NATS, dropped", dropped, "messages so far", err)
+	} else {
+		log.Println("NATS buffer full, dropped", dropped, "messages so far")
+	}
+}
+
+func (sink *NATSSink) Dropped() uint64 {
+	return sink.dropped.Load()
+}
+
+// Close gives the messages waiting for their acknowledgement a few seconds.
+func (sink *NATSSink) Close() error {
+	close(sink.closeChannel)
+	<-sink.done
+
+	if sink.connection == nil {
+		return nil
+	}
+
+	select {
+	case <-sink.jetStream.PublishAsyncComplete():
+	case <-time.After(5 * time.Second):
+		log.Println("gave up waiting for NATS acknowledgements")
+	}
+
+	sink.connection.Close()
+
+	return nil
+}
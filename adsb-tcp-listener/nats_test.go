@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-schema/broker"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// runNATSServer starts an in-process NATS server with JetStream, on a random
+// port when port is -1.
+func runNATSServer(t *testing.T, port int) *server.Server {
+	t.Helper()
+
+	natsServer, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(natsServer.Shutdown)
+
+	return natsServer
+}
+
+// storedMessages reads what the stream holds.
+func storedMessages(t *testing.T, url string, stream string) []jetstream.Msg {
+	t.Helper()
+
+	connection, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	jetStream, err := jetstream.New(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	consumer, err := jetStream.OrderedConsumer(ctx, stream, jetstream.OrderedConsumerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := consumer.FetchNoWait(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []jetstream.Msg
+	for msg := range batch.Messages() {
+		messages = append(messages, msg)
+	}
+
+	return messages
+}
+
+func TestNATSSinkPublishesToTheStream(t *testing.T) {
+	natsServer := runNATSServer(t, -1)
+
+	sink := NewNATSSink(natsServer.ClientURL(), 10)
+	sink.WireFormat = schema.WireFormatBinary
+	err := sink.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sink.Start()
+
+	for n := 1; n <= 3; n++ {
+		sink.SendMessage(numbered(n))
+	}
+	// Close waits for the server to acknowledge what was published
+	time.Sleep(50 * time.Millisecond)
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := storedMessages(t, natsServer.ClientURL(), "ADSB")
+	if len(stored) != 3 || sink.Dropped() != 0 {
+		t.Fatalf("%d messages stored, %d dropped", len(stored), sink.Dropped())
+	}
+	for n, msg := range stored {
+		if msg.Subject() != "adsb.4CA2D6" {
+			t.Errorf("subject %v", msg.Subject())
+		}
+		messages, err := schema.Decode(msg.Headers().Get(broker.NATSContentTypeHeader), msg.Data())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(messages[0].Altitude.Value) != n+1 {
+			t.Errorf("message %d stored at %d", int(messages[0].Altitude.Value), n)
+		}
+	}
+}
+
+func TestNATSSinkConnectsOnceTheServerIsUp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	sink := NewNATSSink("nats://127.0.0.1:"+strconv.Itoa(port), 10)
+	err = sink.Connect()
+	if err == nil {
+		t.Fatal("connected without a server")
+	}
+	go sink.Start()
+	defer sink.Close()
+
+	// the stream is declared when the client connects in the background
+	natsServer := runNATSServer(t, port)
+	connection, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	jetStream, err := jetstream.New(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = jetStream.Stream(context.Background(), "ADSB")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream never declared", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sink.SendMessage(numbered(1))
+	for time.Now().Before(deadline) {
+		if len(storedMessages(t, natsServer.ClientURL(), "ADSB")) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("message never stored, %d dropped", sink.Dropped())
+}
@@ -1,73 +1,517 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
 
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-schema/broker"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// what SendMessage does when the buffer is full
+const (
+	DropOldest = "drop-oldest"
+	DropNewest = "drop-newest"
+	Block      = "block"
+)
+
+// content type of the SBS1 lines sent as dead letters
+const ContentTypeSBS1 = "text/x-sbs1"
+
+// how many AMQP messages can wait for their confirmation at once
+const confirmWindow = 256
+
+var (
+	InvalidDropPolicy = errors.New("invalid drop policy")
+	InvalidWireFormat = errors.New("invalid wire format")
+	MessageNacked     = errors.New("message nacked by the broker")
+	ProducerClosed    = errors.New("producer closed")
+	// batchDue ends the wait for more messages to batch
+	batchDue = errors.New("batch due")
+)
+
+// publishChannel is what the producer needs of an AMQP channel.
+type publishChannel interface {
+	Publish(exchange string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error
+	PublishConfirmed(exchange string, key string, msg amqp.Publishing) (confirmation, error)
+	IsClosed() bool
+}
+
+// confirmation is the broker's answer to a publishing, Wait tells whether it
+// was acked.
+type confirmation interface {
+	Wait() bool
+}
+
+// confirmChannel is an AMQP channel in confirm mode.
+type confirmChannel struct {
+	*amqp.Channel
+}
+
+func (channel confirmChannel) PublishConfirmed(exchange string, key string, msg amqp.Publishing) (confirmation, error) {
+	deferred, err := channel.PublishWithDeferredConfirm(exchange, key, false, false, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return deferred, nil
+}
+
+type inflightBatch struct {
+	messages     []schema.ADSBMessage
+	confirmation confirmation
+}
+
+// Producer is the RabbitMQ sink, it publishes the messages with publisher confirms. Messages
+// wait in a bounded buffer while the broker is unavailable, and in the spool
+// when one is set and the buffer is full. Past that the drop policy applies.
+//
+// With BatchSize above 1, up to BatchSize messages are sent as a single AMQP
+// message holding a JSON array, waiting at most BatchLatency to fill it.
+// WireFormat picks JSON or the more compact binary encoding, consumers tell
+// them apart by their content type. Topology sets how the queue is declared and
+// the messages routed to it.
 type Producer struct {
-	address    string
-	queue      string
-	connection *amqp.Connection
-	channel    *amqp.Channel
+	address      string
+	queue        string
+	connection   *amqp.Connection
+	channel      publishChannel
+	channelClose chan *amqp.Error
+	Topology     broker.Topology
+	DropPolicy   string
+	Reconnect    broker.Backoff
+	Spool        *Spool
+	BatchSize    int
+	BatchLatency time.Duration
+	WireFormat   string
+	buffer       chan schema.ADSBMessage
+	// messages to retry before the buffer, in order
+	pending      []schema.ADSBMessage
+	inflight     []inflightBatch
+	deadLetters  chan DeadLetter
+	closeChannel chan struct{}
+	done         chan struct{}
+	dropped      atomic.Uint64
+	lastDropLog  atomic.Int64
 }
 
-func NewProducer(address string, queue string) *Producer {
+func NewProducer(address string, queue string, bufferSize int) *Producer {
 	return &Producer{
-		address: address,
-		queue:   queue,
+		address:      address,
+		queue:        queue,
+		Topology:     broker.DefaultTopology,
+		DropPolicy:   DropOldest,
+		Reconnect:    broker.DefaultBackoff,
+		BatchSize:    1,
+		BatchLatency: 100 * time.Millisecond,
+		WireFormat:   schema.WireFormatJSON,
+		buffer:       make(chan schema.ADSBMessage, bufferSize),
+		deadLetters:  make(chan DeadLetter, 1000),
+		closeChannel: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+func checkWireFormat(format string) (string, error) {
+	if format == "" {
+		return schema.WireFormatJSON, nil
+	}
+
+	if format != schema.WireFormatJSON && format != schema.WireFormatBinary {
+		return "", InvalidWireFormat
+	}
+
+	return format, nil
+}
+
+func checkDropPolicy(policy string) (string, error) {
+	if policy == "" {
+		return DropOldest, nil
+	}
+
+	if policy != DropOldest && policy != DropNewest && policy != Block {
+		return "", InvalidDropPolicy
 	}
+
+	return policy, nil
+}
+
+// DeadLetters is where sources send the records they cannot parse, published
+// to the dead letter exchange or queue of the topology.
+func (p *Producer) DeadLetters() chan<- DeadLetter {
+	return p.deadLetters
 }
 
+// Dropped is the number of messages lost to the drop policy so far.
+func (p *Producer) Dropped() uint64 {
+	return p.dropped.Load()
+}
+
+// Close stops publishing once the messages waiting for a confirmation are
+// settled. Whatever is left goes to the spool when there is one, and is lost
+// otherwise.
 func (p *Producer) Close() error {
+	p.closeChannel <- struct{}{}
+	<-p.done
+
+	left := len(p.pending) + len(p.buffer)
+	if p.Spool != nil {
+		// what is already spooled came after the rest, it is written back
+		// last
+		spooled, err := p.Spool.Drain()
+		if err != nil {
+			log.Println("failed to read the spool", err)
+		}
+
+		for _, message := range p.pending {
+			p.Spool.Push(message)
+		}
+		for len(p.buffer) > 0 {
+			p.Spool.Push(<-p.buffer)
+		}
+		for _, message := range spooled {
+			p.Spool.Push(message)
+		}
+		log.Println("spooled", left, "unsent messages")
+
+		err = p.Spool.Close()
+		if err != nil {
+			log.Println("failed to close the spool", err)
+		}
+	} else if left > 0 {
+		log.Println("dropping", left, "unsent messages")
+	}
+
+	if p.connection == nil {
+		return nil
+	}
+
 	return p.connection.Close()
 }
 
-func (p *Producer) connect() error {
+func (p *Producer) Connect() error {
 	connection, err := amqp.Dial(p.address)
 	if err != nil {
 		return err
 	}
 
-	p.connection = connection
-
-	channel, err := p.connection.Channel()
+	channel, err := connection.Channel()
 	if err != nil {
+		_ = connection.Close()
 		return err
 	}
-	args := make(amqp.Table)
 
-	args["x-message-ttl"] = 5000            // 5 seconds
-	args["x-max-length"] = 500000           // 500k messages
-	args["x-overflow"] = "drop-head"        // drop oldest message
-	args["x-max-length-bytes"] = 2000000000 // 2GB
+	err = p.Topology.Declare(channel, p.queue)
+	if err != nil {
+		_ = connection.Close()
+		return err
+	}
 
-	_, err = channel.QueueDeclare(p.queue, true, false, false, false, args)
+	err = channel.Confirm(false)
 	if err != nil {
+		_ = connection.Close()
 		return err
 	}
 
-	p.channel = channel
+	// the channel is closed with its connection, watching it covers both
+	p.channelClose = channel.NotifyClose(make(chan *amqp.Error, 1))
+	p.connection = connection
+	p.channel = confirmChannel{channel}
 
 	return nil
 }
 
-func (p *Producer) SendMessage(message ADSBMessage) {
+// reconnect redials the broker until it answers or the producer is closed.
+func (p *Producer) reconnect() bool {
+	if p.connection != nil {
+		_ = p.connection.Close()
+	}
+
+	for attempt := 1; ; attempt++ {
+		delay := p.Reconnect.Delay(attempt)
+		log.Println("Will wait", delay.Round(time.Millisecond), "before reconnecting to RabbitMQ")
+
+		select {
+		case <-p.closeChannel:
+			return false
+		case <-time.After(delay):
+		}
+
+		err := p.Connect()
+		if err == nil {
+			log.Println("Reconnected to RabbitMQ")
+			return true
+		}
+		log.Println("failed to reconnect to RabbitMQ", err)
+	}
+}
+
+// SendMessage queues the message for publishing, it only blocks with the Block
+// policy. While the spool holds messages the new ones are spooled after them,
+// so nothing overtakes what was spooled during an outage: the ingestion
+// service ignores reports older than what it stored.
+func (p *Producer) SendMessage(message schema.ADSBMessage) {
+	if p.Spool != nil && !p.Spool.Empty() && p.Spool.Push(message) {
+		return
+	}
+
+	select {
+	case p.buffer <- message:
+		return
+	default:
+	}
+
+	if p.Spool != nil && p.Spool.Push(message) {
+		return
+	}
+
+	switch p.DropPolicy {
+	case Block:
+		p.buffer <- message
+	case DropNewest:
+		p.drop()
+	default:
+		// make room for the newest, someone else may have taken it already
+		select {
+		case <-p.buffer:
+			p.drop()
+		default:
+		}
+
+		select {
+		case p.buffer <- message:
+		default:
+			p.drop()
+		}
+	}
+}
+
+// drop counts a dropped message. Logging is limited to one line every ten
+// seconds, the buffer stays full for as long as the broker is down.
+func (p *Producer) drop() {
+	dropped := p.dropped.Add(1)
+	if rateLimited(&p.lastDropLog, 10*time.Second) {
+		return
+	}
 
-	body, err := json.Marshal(message)
+	log.Println("producer buffer full, dropped", dropped, "messages so far")
+}
+
+// Start publishes until the producer is closed, reconnecting whenever the
+// channel closes.
+func (p *Producer) Start() {
+	defer close(p.done)
+
+	if p.channel == nil && !p.reconnect() {
+		return
+	}
 
+	for {
+		batch, err := p.nextBatch()
+		if errors.Is(err, ProducerClosed) {
+			_ = p.settle()
+			return
+		}
+
+		if err == nil {
+			err = p.publish(batch)
+		}
+		// confirmations are waited for by batches, while there is more to send
+		if err == nil && len(p.inflight) < confirmWindow && (len(p.pending) > 0 || len(p.buffer) > 0) {
+			continue
+		}
+		if err == nil {
+			err = p.settle()
+		}
+
+		switch {
+		case err == nil:
+		case errors.Is(err, MessageNacked):
+			// the broker is up but refused them, give it a moment
+			log.Println("failed to publish messages", err)
+			time.Sleep(time.Second)
+		default:
+			log.Println("lost the RabbitMQ channel", err)
+			_ = p.settle()
+			if !p.reconnect() {
+				return
+			}
+		}
+	}
+}
+
+// nextBatch collects the messages to send together. On error, what was
+// collected is put back to be sent first.
+func (p *Producer) nextBatch() ([]schema.ADSBMessage, error) {
+	message, err := p.next(nil)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	err = p.channel.Publish("", p.queue, false, false, amqp.Publishing{
-		ContentType: "text/plain",
-		Body:        body,
-		Expiration:  "5000", // 5 seconds
-	})
+	batch := []schema.ADSBMessage{message}
+	if p.BatchSize <= 1 {
+		return batch, nil
+	}
+
+	deadline := time.NewTimer(p.BatchLatency)
+	defer deadline.Stop()
+
+	for len(batch) < p.BatchSize {
+		message, err := p.next(deadline.C)
+		if errors.Is(err, batchDue) {
+			break
+		}
+		if err != nil {
+			p.pending = append(batch, p.pending...)
+			return nil, err
+		}
+		batch = append(batch, message)
+	}
+
+	return batch, nil
+}
+
+// next returns the message to publish: retries first, then the buffer, then
+// the spool once the buffer is empty. The buffer holds what came before the
+// spool, and nothing enters it while the spool holds messages, so they go out
+// in the order they came. It waits until due, forever when nil.
+func (p *Producer) next(due <-chan time.Time) (schema.ADSBMessage, error) {
+	if len(p.pending) == 0 && len(p.buffer) == 0 && p.Spool != nil && !p.Spool.Empty() {
+		spooled, err := p.Spool.Drain()
+		if err != nil {
+			log.Println("failed to read the spool", err)
+		}
+		p.pending = spooled
+	}
+
+	if len(p.pending) > 0 {
+		message := p.pending[0]
+		p.pending = p.pending[1:]
+		return message, nil
+	}
+
+	for {
+		select {
+		case <-p.closeChannel:
+			return schema.ADSBMessage{}, ProducerClosed
+		case amqpErr := <-p.channelClose:
+			return schema.ADSBMessage{}, fmt.Errorf("%w: %v", amqp.ErrClosed, amqpErr)
+		case message := <-p.buffer:
+			return message, nil
+		case letter := <-p.deadLetters:
+			p.publishDeadLetter(letter)
+		case <-due:
+			return schema.ADSBMessage{}, batchDue
+		}
+	}
+}
+
+// publishDeadLetter publishes a record a source could not parse. Dead letters
+// are not confirmed nor retried, they only help finding out what a receiver
+// sends.
+func (p *Producer) publishDeadLetter(letter DeadLetter) {
+	exchange, key, ok := p.Topology.DeadLetterTarget(broker.DeadLetterSBS1)
+	if !ok {
+		return
+	}
 
+	err := p.channel.Publish(exchange, key, false, false, amqp.Publishing{
+		ContentType:  ContentTypeSBS1,
+		Body:         []byte(letter.Record),
+		DeliveryMode: amqp.Persistent,
+		Headers: amqp.Table{
+			broker.HeaderFailureReason: letter.Reason.Error(),
+			broker.HeaderFailedAt:      time.Now().UTC().Format(time.RFC3339),
+			broker.HeaderReceiver:      letter.Receiver,
+		},
+	})
 	if err != nil {
-		panic(err)
+		log.Println("failed to publish dead letter", err)
 	}
 }
+
+// publish sends the batch as one AMQP message per run of messages with the
+// same routing key, a batch can only be routed as a whole.
+func (p *Producer) publish(batch []schema.ADSBMessage) error {
+	runs := p.splitByRoutingKey(batch)
+
+	for i, run := range runs {
+		contentType, body, err := schema.Encode(p.WireFormat, run.messages)
+		if err != nil {
+			log.Println("failed to encode", len(run.messages), "messages, dropping them", err)
+			continue
+		}
+
+		confirmation, err := p.channel.PublishConfirmed(p.Topology.Exchange, run.key, amqp.Publishing{
+			ContentType: contentType,
+			Body:        body,
+			Expiration:  p.Topology.Expiration(),
+		})
+		if err != nil {
+			var unsent []schema.ADSBMessage
+			for _, run := range runs[i:] {
+				unsent = append(unsent, run.messages...)
+			}
+			p.pending = append(unsent, p.pending...)
+			return err
+		}
+
+		p.inflight = append(p.inflight, inflightBatch{messages: run.messages, confirmation: confirmation})
+	}
+
+	return nil
+}
+
+type routedRun struct {
+	key      string
+	messages []schema.ADSBMessage
+}
+
+// splitByRoutingKey splits the batch into runs of consecutive messages with
+// the same routing key. Grouping all the messages of a key together would
+// publish an aircraft's messages out of order, and the ingestion service
+// ignores a report older than what it stored.
+func (p *Producer) splitByRoutingKey(batch []schema.ADSBMessage) []routedRun {
+	var runs []routedRun
+	start := 0
+
+	for i, message := range batch {
+		key := p.Topology.RoutingKey(p.queue, message)
+		if i > 0 && runs[len(runs)-1].key == key {
+			runs[len(runs)-1].messages = batch[start : i+1]
+			continue
+		}
+
+		start = i
+		runs = append(runs, routedRun{key: key, messages: batch[i : i+1]})
+	}
+
+	return runs
+}
+
+// settle waits for every message in flight to be confirmed. Those nacked, or
+// lost with the channel, are queued again in their original order.
+func (p *Producer) settle() error {
+	var retry []schema.ADSBMessage
+	for _, inflight := range p.inflight {
+		if !inflight.confirmation.Wait() {
+			retry = append(retry, inflight.messages...)
+		}
+	}
+	p.inflight = p.inflight[:0]
+
+	if len(retry) == 0 {
+		return nil
+	}
+	p.pending = append(retry, p.pending...)
+
+	if p.channel.IsClosed() {
+		return amqp.ErrClosed
+	}
+
+	return MessageNacked
+}
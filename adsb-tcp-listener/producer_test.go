@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-schema/broker"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func numbered(n int) schema.ADSBMessage {
+	return schema.ADSBMessage{MessageType: schema.MessageTypeTransmission, TransmissionType: 3, HexIdent: "4CA2D6", Altitude: schema.Some(float64(n))}
+}
+
+// spooledProducer is a producer with no broker, a buffer of two messages and
+// a spool.
+func spooledProducer(t *testing.T) *Producer {
+	t.Helper()
+
+	spool, err := NewSpool(filepath.Join(t.TempDir(), "spool"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer := NewProducer("", "sbs1", 2)
+	producer.Spool = spool
+
+	return producer
+}
+
+func expectNext(t *testing.T, producer *Producer, want ...int) {
+	t.Helper()
+
+	for _, n := range want {
+		message, err := producer.next(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(message.Altitude.Value) != n {
+			t.Fatalf("got message %v, want %d", message.Altitude.Value, n)
+		}
+	}
+}
+
+func TestProducerSendsSpoolBeforeNewMessages(t *testing.T) {
+	producer := spooledProducer(t)
+
+	// the broker is down: 1 and 2 fill the buffer, 3 to 5 are spooled
+	for n := 1; n <= 5; n++ {
+		producer.SendMessage(numbered(n))
+	}
+
+	// it is back, and messages keep coming while the buffer drains
+	expectNext(t, producer, 1)
+	producer.SendMessage(numbered(6))
+	expectNext(t, producer, 2, 3)
+	producer.SendMessage(numbered(7))
+	expectNext(t, producer, 4, 5, 6, 7)
+
+	// the spool is empty again, the buffer is used first
+	producer.SendMessage(numbered(8))
+	if !producer.Spool.Empty() {
+		t.Fatal("message spooled with room in the buffer")
+	}
+	expectNext(t, producer, 8)
+}
+
+func TestProducerCloseSpoolsInOrder(t *testing.T) {
+	producer := spooledProducer(t)
+	for n := 1; n <= 5; n++ {
+		producer.SendMessage(numbered(n))
+	}
+	producer.pending = []schema.ADSBMessage{numbered(0)}
+
+	// Start was never called, there is nothing to wait for
+	close(producer.done)
+	err := producer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := NewSpool(producer.Spool.path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	spooled, err := spool.Drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spooled) != 6 {
+		t.Fatalf("got %d spooled messages, want 6", len(spooled))
+	}
+	for n, message := range spooled {
+		if int(message.Altitude.Value) != n {
+			t.Fatalf("message %d spooled at %d", int(message.Altitude.Value), n)
+		}
+	}
+}
+
+func TestSplitByRoutingKeyKeepsOrder(t *testing.T) {
+	producer := NewProducer("", "sbs1", 1)
+	producer.Topology = broker.Topology{Exchange: "adsb", ExchangeType: broker.ExchangeTopic}
+
+	position, velocity := numbered(1), numbered(2)
+	velocity.TransmissionType = 4
+	later := numbered(3)
+
+	runs := producer.splitByRoutingKey([]schema.ADSBMessage{position, velocity, later, later})
+	want := []struct {
+		key   string
+		count int
+	}{{"msg.3", 1}, {"msg.4", 1}, {"msg.3", 2}}
+
+	if len(runs) != len(want) {
+		t.Fatalf("got %d runs, want %d", len(runs), len(want))
+	}
+	for i, run := range runs {
+		if run.key != want[i].key || len(run.messages) != want[i].count {
+			t.Errorf("run %d: got %v with %d messages, want %v with %d", i, run.key, len(run.messages), want[i].key, want[i].count)
+		}
+	}
+
+	// without an exchange everything goes to the queue in one message
+	producer.Topology = broker.DefaultTopology
+	runs = producer.splitByRoutingKey([]schema.ADSBMessage{position, velocity, later})
+	if len(runs) != 1 || runs[0].key != "sbs1" || len(runs[0].messages) != 3 {
+		t.Fatalf("got %+v", runs)
+	}
+}
+
+// answer is a confirmation already received.
+type answer bool
+
+func (acked answer) Wait() bool {
+	return bool(acked)
+}
+
+// discardChannel accepts every publishing without a broker.
+type discardChannel struct {
+	published int
+	bytes     int
+}
+
+func (channel *discardChannel) Publish(_ string, _ string, _ bool, _ bool, msg amqp.Publishing) error {
+	channel.published++
+	channel.bytes += len(msg.Body)
+	return nil
+}
+
+func (channel *discardChannel) PublishConfirmed(exchange string, key string, msg amqp.Publishing) (confirmation, error) {
+	return answer(true), channel.Publish(exchange, key, false, false, msg)
+}
+
+func (channel *discardChannel) IsClosed() bool {
+	return false
+}
+
+// brokerChannel keeps what is published, nacks the messages at the altitudes
+// in nack and fails once closed or failAfter publishings went through.
+type brokerChannel struct {
+	published []int
+	nack      map[int]bool
+	failAfter int
+	closed    bool
+}
+
+func (channel *brokerChannel) Publish(_ string, _ string, _ bool, _ bool, _ amqp.Publishing) error {
+	return nil
+}
+
+func (channel *brokerChannel) PublishConfirmed(_ string, _ string, msg amqp.Publishing) (confirmation, error) {
+	if channel.closed || channel.failAfter > 0 && len(channel.published) >= channel.failAfter {
+		channel.closed = true
+		return nil, amqp.ErrClosed
+	}
+
+	messages, err := schema.Decode(msg.ContentType, msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	acked := true
+	for _, message := range messages {
+		channel.published = append(channel.published, int(message.Altitude.Value))
+		if channel.nack[int(message.Altitude.Value)] {
+			acked = false
+		}
+	}
+
+	return answer(acked), nil
+}
+
+func (channel *brokerChannel) IsClosed() bool {
+	return channel.closed
+}
+
+func altitudes(messages []schema.ADSBMessage) []int {
+	var result []int
+	for _, message := range messages {
+		result = append(result, int(message.Altitude.Value))
+	}
+
+	return result
+}
+
+func TestProducerRetriesNackedMessagesInOrder(t *testing.T) {
+	channel := &brokerChannel{nack: map[int]bool{2: true, 4: true}}
+	producer := NewProducer("", "sbs1", 10)
+	producer.channel = channel
+
+	for n := 1; n <= 5; n++ {
+		err := producer.publish([]schema.ADSBMessage{numbered(n)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	producer.pending = []schema.ADSBMessage{numbered(6)}
+
+	err := producer.settle()
+	if !errors.Is(err, MessageNacked) {
+		t.Fatalf("got %v, want MessageNacked", err)
+	}
+	if got := altitudes(producer.pending); fmt.Sprint(got) != "[2 4 6]" {
+		t.Errorf("pending %v, want [2 4 6]", got)
+	}
+	if len(producer.inflight) != 0 {
+		t.Errorf("%d batches still in flight", len(producer.inflight))
+	}
+
+	// acked this time
+	channel.nack = nil
+	for len(producer.pending) > 0 {
+		batch, err := producer.nextBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = producer.publish(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = producer.settle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(channel.published) != "[1 2 3 4 5 2 4 6]" {
+		t.Errorf("published %v", channel.published)
+	}
+}
+
+func TestProducerKeepsMessagesOfALostChannel(t *testing.T) {
+	channel := &brokerChannel{failAfter: 2}
+	producer := NewProducer("", "sbs1", 10)
+	producer.channel = channel
+	producer.Topology = broker.Topology{Exchange: "adsb", ExchangeType: broker.ExchangeTopic}
+
+	// three runs of routing keys, the channel closes on the last one
+	velocity := numbered(2)
+	velocity.TransmissionType = 4
+	err := producer.publish([]schema.ADSBMessage{numbered(1), velocity, numbered(3), numbered(4)})
+	if !errors.Is(err, amqp.ErrClosed) {
+		t.Fatalf("got %v, want amqp.ErrClosed", err)
+	}
+	if got := altitudes(producer.pending); fmt.Sprint(got) != "[3 4]" {
+		t.Errorf("pending %v, want [3 4]", got)
+	}
+
+	// what was published but never confirmed is sent again, before them
+	producer.inflight[1].confirmation = answer(false)
+	err = producer.settle()
+	if !errors.Is(err, amqp.ErrClosed) {
+		t.Fatalf("got %v, want amqp.ErrClosed", err)
+	}
+	if got := altitudes(producer.pending); fmt.Sprint(got) != "[2 3 4]" {
+		t.Errorf("pending %v, want [2 3 4]", got)
+	}
+}
+
+func TestProducerDropPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{DropOldest, "[2 3]"},
+		{DropNewest, "[1 2]"},
+	}
+	for _, tt := range tests {
+		producer := NewProducer("", "sbs1", 2)
+		producer.DropPolicy = tt.policy
+		for n := 1; n <= 3; n++ {
+			producer.SendMessage(numbered(n))
+		}
+
+		var got []int
+		for len(producer.buffer) > 0 {
+			got = append(got, int((<-producer.buffer).Altitude.Value))
+		}
+		if fmt.Sprint(got) != tt.want || producer.Dropped() != 1 {
+			t.Errorf("%v: kept %v and dropped %d, want %v and 1", tt.policy, got, producer.Dropped(), tt.want)
+		}
+	}
+
+	// blocking waits for room
+	producer := NewProducer("", "sbs1", 1)
+	producer.DropPolicy = Block
+	producer.SendMessage(numbered(1))
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		producer.SendMessage(numbered(2))
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("sent with the buffer full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	expectNext(t, producer, 1)
+	<-sent
+	expectNext(t, producer, 2)
+	if producer.Dropped() != 0 {
+		t.Errorf("blocking dropped %d messages", producer.Dropped())
+	}
+}
+
+// BenchmarkProducerPublish measures the cost of publishing a message on the
+// listener's side, batched or one AMQP message each, without the broker.
+// ns/op is per ADS-B message.
+func BenchmarkProducerPublish(b *testing.B) {
+	messages := make([]schema.ADSBMessage, 500)
+	for i := range messages {
+		messages[i] = numbered(i)
+		messages[i].HexIdent = fmt.Sprintf("%06X", 0x400000+i%50)
+		messages[i].Latitude = schema.Some(52.3086)
+		messages[i].Longitude = schema.Some(4.7639)
+	}
+
+	for _, format := range []string{schema.WireFormatJSON, schema.WireFormatBinary} {
+		for _, batchSize := range []int{1, 100} {
+			b.Run(fmt.Sprintf("%v/batch-%d", format, batchSize), func(b *testing.B) {
+				channel := &discardChannel{}
+				producer := NewProducer("", "sbs1", 1)
+				producer.channel = channel
+				producer.WireFormat = format
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i += batchSize {
+					start := i % len(messages)
+					end := min(start+batchSize, len(messages))
+					err := producer.publish(messages[start:end])
+					if err != nil {
+						b.Fatal(err)
+					}
+					producer.inflight = producer.inflight[:0]
+				}
+
+				b.ReportMetric(float64(channel.bytes)/float64(b.N), "bytes/msg")
+			})
+		}
+	}
+}
+
+func TestProducerKeepsMessagesWhileReconnecting(t *testing.T) {
+	producer := spooledProducer(t)
+	// nothing listens there, every reconnection fails
+	producer.address = "amqp://127.0.0.1:1/"
+	producer.Reconnect = broker.Backoff{Initial: time.Millisecond, Max: time.Millisecond}
+	producer.channel = &brokerChannel{closed: true}
+	producer.channelClose = make(chan *amqp.Error, 1)
+	producer.channelClose <- amqp.ErrClosed
+
+	go producer.Start()
+	for n := 1; n <= 3; n++ {
+		producer.SendMessage(numbered(n))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// closing stops the reconnections, the messages are spooled for the
+	// next start
+	err := producer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := NewSpool(producer.Spool.path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	spooled, err := spool.Drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := altitudes(spooled); fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("spooled %v, want [1 2 3]", got)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+var (
+	InvalidMessageFormat = errors.New("invalid message format")
+	InvalidSBS1Field     = errors.New("invalid SBS1 field")
+)
+
+// sbs1Fields walks the comma separated fields of a line without splitting it,
+// every field is a substring of the line.
+type sbs1Fields struct {
+	line string
+	// ended is set once the last field has been read, short when reading
+	// past it
+	ended bool
+	short bool
+}
+
+func (fields *sbs1Fields) next() string {
+	if fields.ended {
+		fields.short = true
+		return ""
+	}
+
+	end := strings.IndexByte(fields.line, ',')
+	if end < 0 {
+		field := fields.line
+		fields.line = ""
+		fields.ended = true
+		return field
+	}
+
+	field := fields.line[:end]
+	fields.line = fields.line[end+1:]
+
+	return field
+}
+
+// done reports whether the line had exactly the fields read so far.
+func (fields *sbs1Fields) done() bool {
+	return fields.ended && !fields.short
+}
+
+func invalidField(name string, value string) error {
+	return fmt.Errorf("%w: %v %q", InvalidSBS1Field, name, value)
+}
+
+func parseOptionalFloat(name string, value string, min float64, max float64) (schema.Optional[float64], error) {
+	if value == "" {
+		return schema.Optional[float64]{}, nil
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < min || parsed > max {
+		return schema.Optional[float64]{}, invalidField(name, value)
+	}
+
+	return schema.Some(parsed), nil
+}
+
+func parseOptionalInt(name string, value string, min int, max int) (schema.Optional[int], error) {
+	if value == "" {
+		return schema.Optional[int]{}, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < min || parsed > max {
+		return schema.Optional[int]{}, invalidField(name, value)
+	}
+
+	return schema.Some(parsed), nil
+}
+
+// parseFlag reads the SBS1 boolean flags, where -1 means set. Some feeds send
+// 1 instead.
+func parseFlag(name string, value string) (schema.Optional[bool], error) {
+	switch value {
+	case "":
+		return schema.Optional[bool]{}, nil
+	case "-1", "1":
+		return schema.Some(true), nil
+	case "0":
+		return schema.Some(false), nil
+	default:
+		return schema.Optional[bool]{}, invalidField(name, value)
+	}
+}
+
+func isHexIdent(value string) bool {
+	value = strings.TrimPrefix(value, "~")
+	if len(value) != 6 {
+		return false
+	}
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'F' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isSquawk(value string) bool {
+	if len(value) != 4 {
+		return false
+	}
+
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '7' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseMessage parses an SBS1 line of any record type, each with its own
+// layout. Empty fields are left absent rather than read as zero, and any field
+// that does not parse or is out of range rejects the whole line.
+func (client *ADSBClient) parseMessage(message string) (schema.ADSBMessage, error) {
+	fields := sbs1Fields{line: strings.TrimRight(message, "\r\n")}
+
+	var adsbMessage schema.ADSBMessage
+	var err error
+
+	messageType := fields.next()
+	switch messageType {
+	case schema.MessageTypeTransmission:
+		adsbMessage, err = parseTransmission(&fields)
+	case schema.MessageTypeSelectionChange, schema.MessageTypeNewID, schema.MessageTypeNewAircraft, schema.MessageTypeStatusChange, schema.MessageTypeClick:
+		adsbMessage, err = parseEvent(messageType, &fields)
+	default:
+		return schema.ADSBMessage{}, invalidField("message type", messageType)
+	}
+	if err != nil {
+		return schema.ADSBMessage{}, err
+	}
+
+	timezone := client.Timezone
+	if timezone == nil {
+		timezone = time.UTC
+	}
+
+	adsbMessage.IngestTime = time.Now().UTC()
+	adsbMessage.EventTime, err = eventTime(adsbMessage, timezone)
+	if err != nil {
+		return schema.ADSBMessage{}, err
+	}
+
+	return adsbMessage, nil
+}
+
+// eventTime is when the message was generated, or logged by the receiver
+// when that is missing. Records with neither were read as they were sent.
+func eventTime(message schema.ADSBMessage, timezone *time.Location) (time.Time, error) {
+	date, clock := message.DateMessageGenerated, message.TimeMessageGenerated
+	if date == "" || clock == "" {
+		date, clock = message.DateMessageLogged, message.TimeMessageLogged
+	}
+	if date == "" || clock == "" {
+		return message.IngestTime, nil
+	}
+
+	parsed, err := schema.ParseSBS1Time(date, clock, timezone)
+	if err != nil {
+		return time.Time{}, invalidField("timestamp", date+" "+clock)
+	}
+
+	return parsed.UTC(), nil
+}
+
+// parseEvent parses the records BaseStation emits about the aircraft rather
+// than from them. They share the first ten fields of MSG with no transmission
+// type, then SEL and ID carry the callsign and STA the new status.
+func parseEvent(messageType string, fields *sbs1Fields) (schema.ADSBMessage, error) {
+	adsbMessage := schema.ADSBMessage{MessageType: messageType}
+
+	if transmissionType := fields.next(); transmissionType != "" {
+		return schema.ADSBMessage{}, invalidField("transmission type", transmissionType)
+	}
+
+	adsbMessage.SessionId = fields.next()
+	adsbMessage.AircraftId = fields.next()
+	adsbMessage.HexIdent = fields.next()
+	// clicks are not about an aircraft
+	if messageType != schema.MessageTypeClick && !isHexIdent(adsbMessage.HexIdent) {
+		return schema.ADSBMessage{}, invalidField("hex ident", adsbMessage.HexIdent)
+	}
+
+	adsbMessage.FlightId = fields.next()
+	adsbMessage.DateMessageGenerated = fields.next()
+	adsbMessage.TimeMessageGenerated = fields.next()
+	adsbMessage.DateMessageLogged = fields.next()
+	adsbMessage.TimeMessageLogged = fields.next()
+
+	switch messageType {
+	case schema.MessageTypeSelectionChange, schema.MessageTypeNewID:
+		adsbMessage.CallSign = strings.TrimSpace(fields.next())
+	case schema.MessageTypeStatusChange:
+		adsbMessage.Status = fields.next()
+		switch adsbMessage.Status {
+		case schema.StatusPositionLost, schema.StatusSignalLost, schema.StatusRemoved, schema.StatusDeleted, schema.StatusOK:
+		default:
+			return schema.ADSBMessage{}, invalidField("status", adsbMessage.Status)
+		}
+	}
+
+	if !fields.done() {
+		return schema.ADSBMessage{}, InvalidMessageFormat
+	}
+
+	return adsbMessage, nil
+}
+
+// parseTransmission parses the 22 fields of an MSG record.
+func parseTransmission(fields *sbs1Fields) (schema.ADSBMessage, error) {
+	adsbMessage := schema.ADSBMessage{MessageType: schema.MessageTypeTransmission}
+	var err error
+
+	transmissionType := fields.next()
+	adsbMessage.TransmissionType, err = strconv.Atoi(transmissionType)
+	if err != nil || adsbMessage.TransmissionType < 1 || adsbMessage.TransmissionType > 8 {
+		return schema.ADSBMessage{}, invalidField("transmission type", transmissionType)
+	}
+
+	adsbMessage.SessionId = fields.next()
+	adsbMessage.AircraftId = fields.next()
+	adsbMessage.HexIdent = fields.next()
+	if !isHexIdent(adsbMessage.HexIdent) {
+		return schema.ADSBMessage{}, invalidField("hex ident", adsbMessage.HexIdent)
+	}
+
+	adsbMessage.FlightId = fields.next()
+	adsbMessage.DateMessageGenerated = fields.next()
+	adsbMessage.TimeMessageGenerated = fields.next()
+	adsbMessage.DateMessageLogged = fields.next()
+	adsbMessage.TimeMessageLogged = fields.next()
+	adsbMessage.CallSign = strings.TrimSpace(fields.next())
+
+	if adsbMessage.Altitude, err = parseOptionalFloat("altitude", fields.next(), -2000, 150000); err != nil {
+		return schema.ADSBMessage{}, err
+	}
+	if adsbMessage.GroundSpeed, err = parseOptionalFloat("ground speed", fields.next(), 0, 4000); err != nil {
+		return schema.ADSBMessage{}, err
+	}
+	if adsbMessage.Track, err = parseOptionalInt("track", fields.next(), 0, 360); err != nil {
+		return schema.ADSBMessage{}, err
+	}
+	if adsbMessage.Latitude, err = parseOptionalFloat("latitude", fields.next(), -90, 90); err != nil {
+		return schema.ADSBMessage{}, err
+	}
+	if adsbMessage.Longitude, err = parseOptionalFloat("longitude", fields.next(), -180, 180); err != nil {
+		return schema.ADSBMessage{}, err
+	}
+	if adsbMessage.VerticalRate, err = parseOptionalFloat("vertical rate", fields.next(), -30000, 30000); err != nil {
+		return schema.ADSBMessage{}, err
+	}
+
+	adsbMessage.Squawk = fields.next()
+	if adsbMessage.Squawk != "" && !isSquawk(adsbMessage.Squawk) {
+		return schema.ADSBMessage{}, invalidField("squawk", adsbMessage.Squawk)
+	}
+
+	if adsbMessage.Alert, err = parseFlag("alert", fields.next()); err != nil {
+		return schema.ADSBMessage{}, err
+	}
+	if adsbMessage.Emergency, err = parseFlag("emergency", fields.next()); err != nil {
+		return schema.ADSBMessage{}, err
+	}
+	if adsbMessage.Spi, err = parseFlag("spi", fields.next()); err != nil {
+		return schema.ADSBMessage{}, err
+	}
+	if adsbMessage.IsOnGround, err = parseFlag("is on ground", fields.next()); err != nil {
+		return schema.ADSBMessage{}, err
+	}
+
+	if !fields.done() {
+		return schema.ADSBMessage{}, InvalidMessageFormat
+	}
+
+	// a position has both coordinates or none
+	if adsbMessage.Latitude.Valid != adsbMessage.Longitude.Valid {
+		return schema.ADSBMessage{}, invalidField("position", "latitude or longitude alone")
+	}
+
+	return adsbMessage, nil
+}
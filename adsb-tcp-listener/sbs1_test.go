@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+var sbs1Samples = []string{
+	"MSG,1,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,KLM1023 ,,,,,,,,,,,\r\n",
+	"MSG,3,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,35000,,,52.30860,4.76389,,,0,0,0,0\r\n",
+	"MSG,4,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,,451,92,,,-64,,,,,\r\n",
+	"MSG,5,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,35000,,,,,,,0,,0,0\r\n",
+	"MSG,6,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,,,,,,,1000,0,0,0,0\r\n",
+	"STA,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,RM\r\n",
+	"ID,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,KLM1023\r\n",
+	"CLK,,,,,,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000\r\n",
+}
+
+func TestParseMessage(t *testing.T) {
+	client := &ADSBClient{}
+
+	message, err := client.parseMessage(sbs1Samples[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.HexIdent != "4CA2D6" || message.Altitude != schema.Some(35000.0) || message.Latitude != schema.Some(52.3086) {
+		t.Errorf("got %+v", message)
+	}
+	if message.GroundSpeed.Valid || message.Track.Valid {
+		t.Errorf("empty fields must stay absent, got speed %v track %v", message.GroundSpeed, message.Track)
+	}
+
+	for _, line := range []string{
+		"MSG,3,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,35000,,,91,4.7,,,0,0,0,0",
+		"MSG,3,1,1,NOTHEX,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,35000,,,52.3,4.7,,,0,0,0,0",
+		"MSG,3,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,35000,,,52.3,,,,0,0,0,0",
+		"MSG,3,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,35000,,,52.3,4.7,,,0,0,0",
+		"STA,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,XX",
+	} {
+		_, err := client.parseMessage(line)
+		if !errors.Is(err, InvalidSBS1Field) && !errors.Is(err, InvalidMessageFormat) {
+			t.Errorf("%q: got %v, want a rejection", line, err)
+		}
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	client := &ADSBClient{}
+
+	tests := []struct {
+		line string
+		want schema.ADSBMessage
+	}{
+		{
+			"AIR,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000\r\n",
+			schema.ADSBMessage{MessageType: schema.MessageTypeNewAircraft, HexIdent: "4CA2D6"},
+		},
+		{
+			"ID,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,KLM1023 \r\n",
+			schema.ADSBMessage{MessageType: schema.MessageTypeNewID, HexIdent: "4CA2D6", CallSign: "KLM1023"},
+		},
+		{
+			"SEL,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,KLM1023\r\n",
+			schema.ADSBMessage{MessageType: schema.MessageTypeSelectionChange, HexIdent: "4CA2D6", CallSign: "KLM1023"},
+		},
+		{
+			"STA,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,PL\r\n",
+			schema.ADSBMessage{MessageType: schema.MessageTypeStatusChange, HexIdent: "4CA2D6", Status: schema.StatusPositionLost},
+		},
+		{
+			"STA,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,RM\r\n",
+			schema.ADSBMessage{MessageType: schema.MessageTypeStatusChange, HexIdent: "4CA2D6", Status: schema.StatusRemoved},
+		},
+		{
+			// clicks are not about an aircraft
+			"CLK,,,,,,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000\r\n",
+			schema.ADSBMessage{MessageType: schema.MessageTypeClick},
+		},
+	}
+	for _, tt := range tests {
+		message, err := client.parseMessage(tt.line)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if message.MessageType != tt.want.MessageType || message.HexIdent != tt.want.HexIdent || message.CallSign != tt.want.CallSign || message.Status != tt.want.Status {
+			t.Errorf("%q: got %v %v %q %v", tt.line, message.MessageType, message.HexIdent, message.CallSign, message.Status)
+		}
+		if message.TransmissionType != 0 || message.DateMessageGenerated != "2024/03/01" || message.TimeMessageGenerated != "10:00:00.000" {
+			t.Errorf("%q: got transmission type %v at %v %v", tt.line, message.TransmissionType, message.DateMessageGenerated, message.TimeMessageGenerated)
+		}
+	}
+
+	for _, line := range []string{
+		// events have no transmission type
+		"AIR,1,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000",
+		"AIR,,1,1,NOTHEX,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000",
+		// AIR carries no callsign, ID one and no more
+		"AIR,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,KLM1023",
+		"ID,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,KLM1023,0",
+		"STA,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000",
+		"XYZ,,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000",
+	} {
+		_, err := client.parseMessage(line)
+		if !errors.Is(err, InvalidSBS1Field) && !errors.Is(err, InvalidMessageFormat) {
+			t.Errorf("%q: got %v, want a rejection", line, err)
+		}
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, sample := range sbs1Samples {
+		f.Add(sample)
+	}
+	f.Add("")
+	f.Add(",,,,,,,,,,,,,,,,,,,,,")
+
+	client := &ADSBClient{}
+	f.Fuzz(func(t *testing.T, line string) {
+		message, err := client.parseMessage(line)
+		if err != nil {
+			return
+		}
+
+		// what the parser accepts holds together
+		if message.MessageType != schema.MessageTypeClick && !isHexIdent(message.HexIdent) {
+			t.Fatalf("accepted hex ident %q", message.HexIdent)
+		}
+		if message.Latitude.Valid != message.Longitude.Valid {
+			t.Fatalf("accepted half a position %v %v", message.Latitude, message.Longitude)
+		}
+		if message.Latitude.Value < -90 || message.Latitude.Value > 90 || message.Longitude.Value < -180 || message.Longitude.Value > 180 {
+			t.Fatalf("accepted position %v %v", message.Latitude, message.Longitude)
+		}
+		if message.Squawk != "" && !isSquawk(message.Squawk) {
+			t.Fatalf("accepted squawk %q", message.Squawk)
+		}
+		if message.EventTime.IsZero() || message.EventTime.Location().String() != "UTC" {
+			t.Fatalf("event time %v", message.EventTime)
+		}
+	})
+}
+
+// splitParseMessage is the parser before the rewrite, splitting the line and
+// reading empty fields as zero, kept to compare their speed.
+func splitParseMessage(message string) (schema.ADSBMessage, error) {
+	var messageParts = strings.Split(message, ",")
+
+	if len(messageParts) != 22 {
+		return schema.ADSBMessage{}, fmt.Errorf("invalid message format")
+	}
+
+	transmissionType, err := strconv.Atoi(messageParts[1])
+	if err != nil {
+		return schema.ADSBMessage{}, err
+	}
+
+	altitude, _ := strconv.ParseFloat(messageParts[11], 64)
+	groundSpeed, _ := strconv.ParseFloat(messageParts[12], 64)
+	track, _ := strconv.Atoi(messageParts[13])
+	latitude, _ := strconv.ParseFloat(messageParts[14], 64)
+	longitude, _ := strconv.ParseFloat(messageParts[15], 64)
+	verticalRate, _ := strconv.ParseFloat(messageParts[16], 64)
+
+	alert, _ := strconv.ParseBool(messageParts[18])
+	emergency, _ := strconv.ParseBool(messageParts[19])
+	spi, _ := strconv.ParseBool(messageParts[20])
+	isOnGround, _ := strconv.ParseBool(messageParts[21])
+
+	return schema.ADSBMessage{
+		MessageType:          messageParts[0],
+		TransmissionType:     transmissionType,
+		SessionId:            messageParts[2],
+		AircraftId:           messageParts[3],
+		HexIdent:             messageParts[4],
+		FlightId:             messageParts[5],
+		DateMessageGenerated: messageParts[6],
+		TimeMessageGenerated: messageParts[7],
+		DateMessageLogged:    messageParts[8],
+		TimeMessageLogged:    messageParts[9],
+		CallSign:             messageParts[10],
+		Altitude:             schema.Some(altitude),
+		GroundSpeed:          schema.Some(groundSpeed),
+		Track:                schema.Some(track),
+		Latitude:             schema.Some(latitude),
+		Longitude:            schema.Some(longitude),
+		VerticalRate:         schema.Some(verticalRate),
+		Squawk:               messageParts[17],
+		Alert:                schema.Some(alert),
+		Emergency:            schema.Some(emergency),
+		Spi:                  schema.Some(spi),
+		IsOnGround:           schema.Some(isOnGround),
+	}, nil
+}
+
+func BenchmarkParseMessage(b *testing.B) {
+	// the MSG records, the old parser knew no others
+	lines := sbs1Samples[:5]
+	client := &ADSBClient{}
+
+	b.Run("split", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := splitParseMessage(lines[i%len(lines)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("fields", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := client.parseMessage(lines[i%len(lines)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
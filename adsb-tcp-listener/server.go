@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+	"github.com/fabricekabongo/adsb-tcp-listener/modes"
+)
+
+// ConnectionStats is what we account for every feeder connected to us.
+type ConnectionStats struct {
+	RemoteAddress  string
+	ConnectedSince time.Time
+	Received       uint64
+	ParseFailures  uint64
+}
+
+// InboundServer accepts connections from feeders pushing their data to us
+// (e.g. readsb --net-connector), and reads each of them like an ADSBClient.
+type InboundServer struct {
+	Address         string
+	Format          string
+	MaxConnections  int
+	MessagesChannel chan schema.ADSBMessage
+	Timezone        *time.Location
+	listener        net.Listener
+	mutex           sync.Mutex
+	// connected feeders and when they connected
+	connections map[*ADSBClient]time.Time
+	hasReceiver bool
+	receiverLat float64
+	receiverLon float64
+	deadLetters chan<- DeadLetter
+}
+
+func NewInboundServer(address string, format string, maxConnections int) (*InboundServer, error) {
+	format, err := checkFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InboundServer{
+		Address:         address,
+		Format:          format,
+		MaxConnections:  maxConnections,
+		MessagesChannel: make(chan schema.ADSBMessage, 2000),
+		Timezone:        time.UTC,
+		connections:     make(map[*ADSBClient]time.Time),
+	}, nil
+}
+
+// SetReceiverLocation is used as the CPR reference of every feeder, they are
+// expected to be in the same area.
+func (server *InboundServer) SetReceiverLocation(latitude float64, longitude float64) {
+	server.hasReceiver = true
+	server.receiverLat = latitude
+	server.receiverLon = longitude
+}
+
+// SetDeadLetters sends the SBS1 lines of every feeder that fail to parse to
+// deadLetters.
+func (server *InboundServer) SetDeadLetters(deadLetters chan<- DeadLetter) {
+	server.deadLetters = deadLetters
+}
+
+func (server *InboundServer) Messages() chan schema.ADSBMessage {
+	return server.MessagesChannel
+}
+
+func (server *InboundServer) Connect() error {
+	listener, err := net.Listen("tcp", server.Address)
+	if err != nil {
+		log.Println("failed to listen on", server.Address, err)
+		return err
+	}
+
+	server.listener = listener
+
+	return nil
+}
+
+func (server *InboundServer) Close() error {
+	err := server.listener.Close()
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for client := range server.connections {
+		_ = client.Connection.Close()
+	}
+
+	return err
+}
+
+// Stats returns the accounting of the feeders currently connected.
+func (server *InboundServer) Stats() []ConnectionStats {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	stats := make([]ConnectionStats, 0, len(server.connections))
+	for client, since := range server.connections {
+		stats = append(stats, ConnectionStats{
+			RemoteAddress:  client.Connection.RemoteAddr().String(),
+			ConnectedSince: since,
+			Received:       client.Received(),
+			ParseFailures:  client.ParseFailures(),
+		})
+	}
+
+	return stats
+}
+
+// StartListening accepts feeders until the server is closed. Each connection
+// gets its own parse workers.
+func (server *InboundServer) StartListening(workers int) {
+	done := make(chan struct{})
+	defer close(done)
+	go server.logStats(done)
+
+	for {
+		connection, err := server.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("failed to accept feeder connection", err)
+			continue
+		}
+
+		client := server.register(connection)
+		if client == nil {
+			log.Println("too many feeder connections, rejecting", connection.RemoteAddr())
+			_ = connection.Close()
+			continue
+		}
+
+		go server.handle(client, workers)
+	}
+}
+
+// register accounts for a new feeder, or returns nil when the server is full.
+func (server *InboundServer) register(connection net.Conn) *ADSBClient {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.MaxConnections > 0 && len(server.connections) >= server.MaxConnections {
+		return nil
+	}
+
+	positions := modes.NewPositionDecoder()
+	if server.hasReceiver {
+		positions.SetReceiverLocation(server.receiverLat, server.receiverLon)
+	}
+
+	client := &ADSBClient{
+		Format:          server.Format,
+		Connection:      connection,
+		MessagesChannel: make(chan schema.ADSBMessage, 2000),
+		Timezone:        server.Timezone,
+		closeChannel:    make(chan struct{}, 1),
+		positions:       positions,
+		inbound:         true,
+		deadLetters:     server.deadLetters,
+	}
+	server.connections[client] = time.Now()
+
+	return client
+}
+
+func (server *InboundServer) handle(client *ADSBClient, workers int) {
+	connection := client.Connection
+
+	server.mutex.Lock()
+	since := server.connections[client]
+	server.mutex.Unlock()
+
+	log.Println("feeder connected", connection.RemoteAddr())
+
+	// tag every message with the feeder address, the port changes on every
+	// reconnection so it is left out
+	receiverId := connection.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(receiverId); err == nil {
+		receiverId = host
+	}
+
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for message := range client.MessagesChannel {
+			message.ReceiverId = receiverId
+			server.MessagesChannel <- message
+		}
+	}()
+
+	client.StartListening(workers)
+	close(client.MessagesChannel)
+	<-forwarded
+	_ = connection.Close()
+
+	server.mutex.Lock()
+	delete(server.connections, client)
+	server.mutex.Unlock()
+
+	log.Println("feeder disconnected", connection.RemoteAddr(), "after", time.Since(since).Round(time.Second), "and", client.Received(), "messages")
+}
+
+func (server *InboundServer) logStats(done chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, stats := range server.Stats() {
+			log.Println("feeder", stats.RemoteAddress, "connected for", time.Since(stats.ConnectedSince).Round(time.Second), "received", stats.Received, "messages,", stats.ParseFailures, "unparseable")
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testInboundServer(t *testing.T, maxConnections int) *InboundServer {
+	t.Helper()
+
+	server, err := NewInboundServer("127.0.0.1:0", FormatSBS1, maxConnections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.StartListening(2)
+	t.Cleanup(func() { _ = server.Close() })
+
+	return server
+}
+
+func dialFeeder(t *testing.T, server *InboundServer) net.Conn {
+	t.Helper()
+
+	connection, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = connection.Close() })
+
+	return connection
+}
+
+// waitForStats waits until the server accounts for want feeders.
+func waitForStats(t *testing.T, server *InboundServer, want func([]ConnectionStats) bool) []ConnectionStats {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := server.Stats()
+		if want(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got stats %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInboundServerCountsPerConnection(t *testing.T) {
+	server := testInboundServer(t, 0)
+
+	first := dialFeeder(t, server)
+	second := dialFeeder(t, server)
+
+	_, err := first.Write([]byte(sbs1Line("4CA2D6", 1) + sbs1Line("4CA2D6", 2) + "MSG,3,1,1,4CA2D6,1,2024/03/01,10:00:00.000,2024/03/01,10:00:00.000,,high,,,,,,,,,,\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = second.Write([]byte(sbs1Line("3C6444", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := waitForStats(t, server, func(stats []ConnectionStats) bool {
+		var received, failures uint64
+		for _, connection := range stats {
+			received += connection.Received
+			failures += connection.ParseFailures
+		}
+		return len(stats) == 2 && received == 4 && failures == 1
+	})
+
+	for _, connection := range stats {
+		switch connection.RemoteAddress {
+		case first.LocalAddr().String():
+			if connection.Received != 3 || connection.ParseFailures != 1 {
+				t.Errorf("first feeder: %+v", connection)
+			}
+		case second.LocalAddr().String():
+			if connection.Received != 1 || connection.ParseFailures != 0 {
+				t.Errorf("second feeder: %+v", connection)
+			}
+		default:
+			t.Errorf("unknown feeder %+v", connection)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case message := <-server.MessagesChannel:
+			if message.ReceiverId != "127.0.0.1" {
+				t.Errorf("tagged %q", message.ReceiverId)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of 3 messages", i)
+		}
+	}
+
+	// a feeder leaving is no longer accounted for
+	_ = first.Close()
+	waitForStats(t, server, func(stats []ConnectionStats) bool { return len(stats) == 1 })
+}
+
+func TestInboundServerMaxConnections(t *testing.T) {
+	server := testInboundServer(t, 1)
+
+	first := dialFeeder(t, server)
+	waitForStats(t, server, func(stats []ConnectionStats) bool { return len(stats) == 1 })
+
+	// the server is full, the second feeder is hung up on
+	second := dialFeeder(t, server)
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := second.Read(make([]byte, 1))
+	if err == nil || isTimeout(err) {
+		t.Fatalf("the second feeder was kept: %v", err)
+	}
+	if len(server.Stats()) != 1 {
+		t.Errorf("accounting for %d feeders", len(server.Stats()))
+	}
+
+	// once the first one leaves there is room again
+	_ = first.Close()
+	waitForStats(t, server, func(stats []ConnectionStats) bool { return len(stats) == 0 })
+	dialFeeder(t, server)
+	waitForStats(t, server, func(stats []ConnectionStats) bool { return len(stats) == 1 })
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+const (
+	SinkRabbitMQ = "rabbitmq"
+	SinkKafka    = "kafka"
+	SinkMQTT     = "mqtt"
+	SinkNATS     = "nats"
+)
+
+var (
+	InvalidSink = errors.New("invalid sink")
+)
+
+// Sink is where the listener sends the messages. SendMessage must not block
+// for long, a sink that cannot keep up buffers or drops.
+type Sink interface {
+	Connect() error
+	// Start sends the messages until the sink is closed.
+	Start()
+	SendMessage(message schema.ADSBMessage)
+	// Dropped is the number of messages lost so far.
+	Dropped() uint64
+	Close() error
+}
+
+func checkSink(sink string) (string, error) {
+	if sink == "" {
+		return SinkRabbitMQ, nil
+	}
+
+	if sink != SinkRabbitMQ && sink != SinkKafka && sink != SinkMQTT && sink != SinkNATS {
+		return "", InvalidSink
+	}
+
+	return sink, nil
+}
+
+// rateLimited tells whether something was already logged within the period,
+// and records now as the last time otherwise.
+func rateLimited(last *atomic.Int64, period time.Duration) bool {
+	now := time.Now().UnixNano()
+	previous := last.Load()
+
+	return now-previous < int64(period) || !last.CompareAndSwap(previous, now)
+}
@@ -0,0 +1,25 @@
+package main
+
+import schema "github.com/fabricekabongo/adsb-schema"
+
+// Source is a feed of ADSB messages, whether we read it from a receiver port
+// or poll it over HTTP.
+type Source interface {
+	Connect() error
+	StartListening(workers int)
+	Messages() chan schema.ADSBMessage
+	Close() error
+}
+
+// DeadLetter is a record a source could not parse, kept to be looked at.
+type DeadLetter struct {
+	Record   string
+	Receiver string
+	Reason   error
+}
+
+// DeadLettering is implemented by the sources that can hand the records they
+// cannot parse over, rather than only counting them.
+type DeadLettering interface {
+	SetDeadLetters(deadLetters chan<- DeadLetter)
+}
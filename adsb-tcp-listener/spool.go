@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+
+	schema "github.com/fabricekabongo/adsb-schema"
+)
+
+// Spool keeps on disk the messages the producer buffer has no room for while
+// the broker is unavailable, one JSON message per line. What is left in it
+// when the listener stops is sent on the next start.
+type Spool struct {
+	path     string
+	maxBytes int64
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+func NewSpool(path string, maxBytes int64) (*Spool, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &Spool{
+		path:     path,
+		maxBytes: maxBytes,
+		file:     file,
+		size:     info.Size(),
+	}, nil
+}
+
+// Push appends the message, or returns false when the spool is full.
+func (spool *Spool) Push(message schema.ADSBMessage) bool {
+	line, err := json.Marshal(message)
+	if err != nil {
+		log.Println("failed to encode message for the spool", err)
+		return false
+	}
+	line = append(line, '\n')
+
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	if spool.maxBytes > 0 && spool.size+int64(len(line)) > spool.maxBytes {
+		return false
+	}
+
+	n, err := spool.file.Write(line)
+	spool.size += int64(n)
+	if err != nil {
+		log.Println("failed to write to the spool", err)
+		return false
+	}
+
+	return true
+}
+
+// Empty tells whether there is nothing to drain.
+func (spool *Spool) Empty() bool {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	return spool.size == 0
+}
+
+// Drain reads back every spooled message and empties the spool. Lines that no
+// longer decode are skipped.
+func (spool *Spool) Drain() ([]schema.ADSBMessage, error) {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	if spool.size == 0 {
+		return nil, nil
+	}
+
+	file, err := os.Open(spool.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var messages []schema.ADSBMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var message schema.ADSBMessage
+		if json.Unmarshal(scanner.Bytes(), &message) != nil {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	err = spool.file.Truncate(0)
+	if err != nil {
+		return nil, err
+	}
+	spool.size = 0
+
+	return messages, nil
+}
+
+func (spool *Spool) Close() error {
+	return spool.file.Close()
+}